@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http/httputil"
 	"sync"
+	"time"
 
 	"example.com/internal/stubby"
 )
@@ -25,23 +28,62 @@ type targets struct {
 	Prefixes []stubby.Target `json:"prefixes"`
 }
 
+func (t *targets) compile() error {
+	var errs []error
+
+	if err := t.Default.Compile(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid default target: %w", err))
+	}
+
+	for i := range t.Prefixes {
+		if err := t.Prefixes[i].Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid target %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// settings holds the content of the configuration file.
+type settings struct {
+	targets
+	stubby.MatcherOptions
+	Redactions    []stubby.Redaction   `json:"redactions"`
+	Recording     *stubby.RecordFilter `json:"recording"`
+	Naming        *stubby.Naming       `json:"naming"`
+	ResponseRules stubby.ResponseRules `json:"responseRules"`
+}
+
 type config struct {
-	baseURL      string
-	httpPort     int
-	stubDir      string
-	ignoredPaths []string
-	targets      *targets
+	baseURL        string
+	httpPort       int
+	stubDir        string
+	descriptorSet  string
+	ignoredPaths   []string
+	targets        *targets
+	redactor       *stubby.Redactor
+	recordFilter   *stubby.RecordFilter
+	naming         *stubby.Naming
+	matcherOptions stubby.MatcherOptions
+	responseRules  stubby.ResponseRules
+	reloadInterval time.Duration
+	debugHeaders   bool
 }
 
 type application struct {
-	config      config
-	logger      *slog.Logger
-	wg          sync.WaitGroup
-	proxy       *httputil.ReverseProxy
-	status      Status
-	statusLock  sync.RWMutex
-	profile     string
-	recordsLock sync.Mutex
-	records     []*stubby.Record
-	matcher     *stubby.Matcher
+	config        config
+	logger        *slog.Logger
+	wg            sync.WaitGroup
+	proxy         *httputil.ReverseProxy
+	status        Status
+	statusLock    sync.RWMutex
+	profile       string
+	recordsLock   sync.Mutex
+	recordQueue   chan pendingRecord
+	writerStopped chan struct{}
+	recordedKeys  map[string]struct{}
+	sessionLock   sync.Mutex
+	session       *session
+	matcher       *stubby.Matcher
+	descriptors   *stubby.Descriptors
 }
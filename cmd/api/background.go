@@ -4,11 +4,23 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
-	"time"
 
 	"example.com/internal/stubby"
 )
 
+const (
+	recordQueueSize = 256
+	recordBatchSize = 64
+)
+
+// pendingRecord is queued as soon as a response is forwarded, so the writer
+// keeps the order of the responses while the record is built in the
+// background. A pending record without record channel is a flush request.
+type pendingRecord struct {
+	record  chan *stubby.Record
+	flushed chan struct{}
+}
+
 func (app *application) backgroundTask(r *http.Request, fn func() error) {
 	app.wg.Add(1)
 
@@ -29,59 +41,96 @@ func (app *application) backgroundTask(r *http.Request, fn func() error) {
 	}()
 }
 
-func (app *application) watchRecords(done chan struct{}) {
-	app.logger.Debug("startWatchingRecords")
-	ticker := time.NewTicker(time.Second)
-
-	for {
-		select {
-		case <-done:
-			app.logger.Debug("stopWatchingRecords")
-			return
-		case <-ticker.C:
-			app.checkRecords()
-		}
-	}
+// queueRecord reserves a place in the write queue. The returned channel must
+// receive the record, or nil when it could not be built. When the queue is
+// full, the caller blocks until the writer catches up.
+func (app *application) queueRecord() chan<- *stubby.Record {
+	record := make(chan *stubby.Record, 1)
+	app.recordQueue <- pendingRecord{record: record}
+	return record
+}
+
+// flushRecords blocks until every record queued before the call is written.
+func (app *application) flushRecords() {
+	app.logger.Debug("flushingRecords")
+
+	flushed := make(chan struct{})
+	app.recordQueue <- pendingRecord{flushed: flushed}
+	<-flushed
+
+	app.logger.Debug("recordsFlushed")
 }
 
-func (app *application) checkRecords() {
-	app.recordsLock.Lock()
-	records := make([]*stubby.Record, len(app.records))
-	copy(records, app.records)
-	app.records = nil
-	app.recordsLock.Unlock()
+// writeRecords groups the queued records by file and writes every file once
+// per batch. A batch is written when the queue is empty, when it is full or
+// when a flush is requested. It returns when the queue is closed.
+func (app *application) writeRecords() {
+	app.logger.Debug("startWritingRecords")
+	defer close(app.writerStopped)
+
+	batch := make(map[string][]*stubby.Record)
+	var files []string
+	var flushes []chan struct{}
+	var size int
+
+	for pending := range app.recordQueue {
+		if pending.record != nil {
+			if record := <-pending.record; record != nil {
+				file := app.config.naming.Filepath(record)
+				if _, ok := batch[file]; !ok {
+					files = append(files, file)
+				}
+				batch[file] = append(batch[file], record)
+				size++
+			}
+		}
+
+		if pending.flushed != nil {
+			flushes = append(flushes, pending.flushed)
+		}
+
+		if len(app.recordQueue) > 0 && size < recordBatchSize && len(flushes) == 0 {
+			continue
+		}
+
+		for _, file := range files {
+			app.writeFile(file, batch[file])
+		}
+
+		for _, flushed := range flushes {
+			close(flushed)
+		}
+
+		batch = make(map[string][]*stubby.Record)
+		files, flushes, size = nil, nil, 0
+	}
 
-	for _, record := range records {
-		app.writeFile(record)
-		app.wg.Done()
+	for _, file := range files {
+		app.writeFile(file, batch[file])
 	}
+
+	app.logger.Debug("stopWritingRecords")
 }
 
-func (app *application) writeFile(record *stubby.Record) {
-	fullPath := app.fullPath(record)
+func (app *application) writeFile(file string, records []*stubby.Record) {
+	fullPath := filepath.Join(app.config.stubDir, file)
 
-	err := stubby.WriteToFile(fullPath, record)
+	added, written, err := stubby.WriteToFile(fullPath, records, app.config.recordFilter.Deduplication())
 	if err != nil {
-		app.logger.Debug("writeFileFailed",
+		app.logger.Error("writeFileFailed",
 			"stub.path", fullPath,
-			"stub.file", record.Filepath(),
-			"http.method", record.Request.Method,
-			"http.path", record.Request.Pathname,
-			"http.query", record.Request.Query,
-			"http.status_code", record.Response.StatusCode,
+			"stub.records", len(records),
+			"error", err,
 		)
+		app.recordsFailed(records, err.Error())
+		return
 	}
 
+	app.recordsWritten(file, added, written)
+
 	app.logger.Debug("writeFileSucceed",
-		"stub.path", record.Filepath(),
-		"stub.file", record.Filepath(),
-		"http.method", record.Request.Method,
-		"http.path", record.Request.Pathname,
-		"http.query", record.Request.Query,
-		"http.status_code", record.Response.StatusCode,
+		"stub.path", fullPath,
+		"stub.records", added,
+		"stub.bytes", written,
 	)
 }
-
-func (app *application) fullPath(record *stubby.Record) string {
-	return filepath.Join(app.config.stubDir, record.Filepath())
-}
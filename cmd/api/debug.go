@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"example.com/internal/stubby"
+)
+
+const (
+	headerMode      = "X-Stubby-Mode"
+	headerSource    = "X-Stubby-Source"
+	headerStubFile  = "X-Stubby-Stub-File"
+	headerStubIndex = "X-Stubby-Stub-Index"
+	headerTarget    = "X-Stubby-Target"
+
+	sourceStub     = "stub"
+	sourceUpstream = "upstream"
+)
+
+var debugHeaders = []string{headerMode, headerSource, headerStubFile, headerStubIndex, headerTarget}
+
+// setDebugHeaders describes how the request is served, when the debug headers
+// are enabled. The request is served by the target until a stub matches.
+func (app *application) setDebugHeaders(w http.ResponseWriter, status Status, target *stubby.Target) {
+	if !app.config.debugHeaders {
+		return
+	}
+
+	header := w.Header()
+	header.Set(headerMode, status.String())
+	header.Set(headerSource, sourceUpstream)
+	if target.Prefix != "" {
+		header.Set(headerTarget, target.Prefix+" -> "+target.String())
+	} else {
+		header.Set(headerTarget, target.String())
+	}
+	header.Add("Access-Control-Expose-Headers", strings.Join(debugHeaders, ", "))
+}
+
+func (app *application) setStubHeaders(w http.ResponseWriter, record *stubby.Record) {
+	if !app.config.debugHeaders {
+		return
+	}
+
+	header := w.Header()
+	header.Set(headerSource, sourceStub)
+	header.Set(headerStubFile, stubFile(record))
+	header.Set(headerStubIndex, strconv.Itoa(record.Index))
+}
+
+// stubFile returns the path of the file the stub was loaded from, relative
+// to the stub directory.
+func stubFile(record *stubby.Record) string {
+	return filepath.Join(record.Profile, record.File)
+}
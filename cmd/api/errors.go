@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"example.com/internal/response"
+	"example.com/internal/stubby"
 )
 
 func (app *application) reportServerError(r *http.Request, err error) {
@@ -39,6 +40,25 @@ func (app *application) serverError(w http.ResponseWriter, r *http.Request, err
 	app.errorMessage(w, r, http.StatusInternalServerError, message, nil)
 }
 
+func (app *application) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	app.reportServerError(r, err)
+
+	if rw, ok := w.(*response.Wrapper); ok {
+		rw.SetError(err)
+	}
+
+	app.upstreamFailure(w, r, stubby.NewFailure(err))
+}
+
+func (app *application) upstreamFailure(w http.ResponseWriter, r *http.Request, failure *stubby.Failure) {
+	status := http.StatusBadGateway
+	if failure.Kind == stubby.FailureTimeout {
+		status = http.StatusGatewayTimeout
+	}
+
+	app.errorMessage(w, r, status, failure.Message, nil)
+}
+
 func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
 	message := "The requested resource could not be found"
 	app.errorMessage(w, r, http.StatusNotFound, message, nil)
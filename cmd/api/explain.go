@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"example.com/internal/response"
+	"example.com/internal/stubby"
+)
+
+// explainHandler explains how the described request would be matched by the
+// replayed profile, without changing the sequence of the stubs.
+func (app *application) explainHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		app.badRequest(w, r, fmt.Errorf("invalid request description: %w", err))
+		return
+	}
+
+	app.statusLock.RLock()
+	status, matcher := app.status, app.matcher
+	app.statusLock.RUnlock()
+
+	if status != Replaying || matcher == nil {
+		app.unprocessableEntity(w, r, errors.New("no profile is replayed"))
+		return
+	}
+
+	if input.Method == "" {
+		input.Method = http.MethodGet
+	}
+
+	// a JSON string is sent as is, any other JSON value is sent encoded
+	body := []byte(input.Body)
+	var text string
+	if json.Unmarshal(input.Body, &text) == nil {
+		body = []byte(text)
+	}
+
+	described, err := http.NewRequestWithContext(r.Context(), input.Method, input.URL, bytes.NewReader(body))
+	if err != nil {
+		app.badRequest(w, r, fmt.Errorf("invalid request description: %w", err))
+		return
+	}
+	for name, value := range input.Headers {
+		described.Header.Set(name, value)
+	}
+
+	app.rewrite(described)
+
+	err = response.JSON(w, http.StatusOK, matcher.Explain(described))
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// explainMiss logs the stubs closest to a request that did not match, only
+// when debug logs are enabled.
+func (app *application) explainMiss(r *http.Request, matcher *stubby.Matcher) {
+	if !app.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	explanation := matcher.Explain(r)
+
+	for _, candidate := range explanation.Candidates {
+		attrs := []any{
+			"http.method", r.Method,
+			"http.path", r.URL.Path,
+			"http.query", r.URL.RawQuery,
+			"stub.profile", candidate.Profile,
+			"stub.file", candidate.File,
+			"stub.index", candidate.Index,
+		}
+		for _, difference := range candidate.Differences {
+			attrs = append(attrs, slog.Group("diff."+difference.Field,
+				"stub", difference.Stub,
+				"request", difference.Request,
+				"hint", difference.Hint,
+			))
+		}
+
+		app.logger.Debug("stubMissed", attrs...)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"example.com/internal/stubby"
@@ -14,15 +16,27 @@ import (
 )
 
 func (app *application) statusHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeStatus(w, r, nil)
+}
+
+// writeStatus answers with the current status, and the summary of the
+// recording when there is one.
+func (app *application) writeStatus(w http.ResponseWriter, r *http.Request, recording *session) {
 	app.statusLock.RLock()
 	data := struct {
-		Profile string   `json:"profile"`
-		Status  string   `json:"status"`
-		Targets *targets `json:"targets"`
+		Profile   string              `json:"profile"`
+		Status    string              `json:"status"`
+		Targets   *targets            `json:"targets"`
+		Recording *session            `json:"recording,omitempty"`
+		Errors    []*stubby.FileError `json:"errors,omitempty"`
 	}{
-		Profile: app.profile,
-		Status:  app.status.String(),
-		Targets: app.config.targets,
+		Profile:   app.profile,
+		Status:    app.status.String(),
+		Targets:   app.config.targets,
+		Recording: recording,
+	}
+	if app.status == Replaying && app.matcher != nil {
+		data.Errors = app.matcher.Errors()
 	}
 	app.statusLock.RUnlock()
 
@@ -39,9 +53,14 @@ func (app *application) recordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	app.changeStatus(Recording, profile)
+	if strings.Contains(profile, stubby.LayerSeparator) {
+		app.badRequest(w, r, fmt.Errorf("layered profile %s can only be replayed", profile))
+		return
+	}
+
+	recording := app.changeStatus(Recording, profile, nil)
 
-	app.statusHandler(w, r)
+	app.writeStatus(w, r, recording)
 }
 
 func (app *application) replayHandler(w http.ResponseWriter, r *http.Request) {
@@ -51,33 +70,63 @@ func (app *application) replayHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	app.changeStatus(Replaying, profile)
+	strict := false
+	if value := r.URL.Query().Get("strict"); value != "" {
+		strict, err = strconv.ParseBool(value)
+		if err != nil {
+			app.badRequest(w, r, fmt.Errorf("invalid strict value %s", value))
+			return
+		}
+	}
+
+	// the stubs recorded until now are written before the profile is loaded,
+	// so they are replayed
+	if status, _ := app.currentStatus(); status == Recording {
+		app.flushRecords()
+	}
 
-	err = app.loadProfile(profile)
+	matcher, err := app.loadProfile(profile)
 	if err != nil {
 		app.unprocessableEntity(w, r, err)
 		return
 	}
 
-	app.statusHandler(w, r)
+	if errs := matcher.Errors(); strict && len(errs) > 0 {
+		app.unprocessableEntity(w, r, fmt.Errorf("failed to load profile %s: %w", profile, errors.Join(fileErrors(errs)...)))
+		return
+	}
+
+	recording := app.changeStatus(Replaying, profile, matcher)
+
+	app.writeStatus(w, r, recording)
 }
 
 func (app *application) forwardHandler(w http.ResponseWriter, r *http.Request) {
-	app.changeStatus(Forwarding, "")
+	recording := app.changeStatus(Forwarding, "", nil)
 
-	app.statusHandler(w, r)
+	app.writeStatus(w, r, recording)
+}
+
+func (app *application) flushHandler(w http.ResponseWriter, r *http.Request) {
+	app.flushRecords()
+
+	app.writeStatus(w, r, app.sessionSummary())
 }
 
 func (app *application) forward(w http.ResponseWriter, r *http.Request) {
-	app.rewrite(r)
+	target := app.rewrite(r)
+
+	status, profile := app.currentStatus()
+	app.setDebugHeaders(w, status, target)
 
-	status := app.currentStatus()
 	if app.replay(status, w, r) {
 		return
 	}
 
+	request := app.describeRequest(r)
+
 	rw := &response.Wrapper{ResponseWriter: w}
-	app.proxy.ServeHTTP(rw, r)
+	app.proxy.ServeHTTP(rw, withForwarded(r, status, target))
 
 	app.logger.Info("responseForwarded",
 		"http.method", r.Method,
@@ -88,24 +137,27 @@ func (app *application) forward(w http.ResponseWriter, r *http.Request) {
 		"http.content_type", rw.ContentType(),
 	)
 
-	app.record(status, rw, r)
+	app.record(status, profile, rw, r, request, target)
 }
 
-func (app *application) rewrite(r *http.Request) {
-	var found bool
+// rewrite forwards the request to the most specific target it matches, the
+// first one in the configuration file on a tie, or to the default target.
+func (app *application) rewrite(r *http.Request) *stubby.Target {
+	var target *stubby.Target
 
-	for _, targetURL := range app.config.targets.Prefixes {
-		if targetURL.Matches(r) {
-			targetURL.Rewrite(r)
-			found = true
-			break
+	for i := range app.config.targets.Prefixes {
+		candidate := &app.config.targets.Prefixes[i]
+		if candidate.Matches(r) && (target == nil || candidate.MoreSpecific(target)) {
+			target = candidate
 		}
 	}
 
-	if !found {
-		app.config.targets.Default.Rewrite(r)
+	if target == nil {
+		target = &app.config.targets.Default
 	}
 
+	target.Rewrite(r)
+
 	app.logger.Debug("requestModified",
 		"http.method", r.Method,
 		"http.host", r.URL.Host,
@@ -113,9 +165,44 @@ func (app *application) rewrite(r *http.Request) {
 		"http.scheme", r.URL.Scheme,
 		"http.query", r.URL.RawQuery,
 	)
+
+	return target
+}
+
+// describeRequest captures the request before it is proxied, while its body
+// can still be read. The host and the path are normalized like the requests
+// matched during the replay, and the generated values are replaced by their
+// placeholders.
+func (app *application) describeRequest(r *http.Request) stubby.Request {
+	normalization := app.config.matcherOptions.Normalization
+	placeholders := app.config.matcherOptions.Placeholders
+
+	request := stubby.Request{
+		Host:     normalization.Host(r.URL.Host),
+		Pathname: placeholders.Pathname(normalization.Pathname(r.URL.Path)),
+		Method:   r.Method,
+		Query:    placeholders.Query(response.QueryToJSON(r.URL.Query())),
+	}
+
+	if graphQL, ok := stubby.ParseGraphQL(r); ok {
+		request.GraphQL = graphQL
+		app.logger.Debug("graphQLDetected",
+			"http.method", r.Method,
+			"http.path", r.URL.Path,
+			"graphql.operation", graphQL.OperationName,
+		)
+	}
+
+	if form, ok := stubby.ParseForm(r); ok {
+		request.Form = form
+	}
+
+	return request
 }
 
-func (app *application) record(status Status, rw *response.Wrapper, r *http.Request) {
+// record saves the response in the profile being recorded when the request
+// was received, even if the status changed since.
+func (app *application) record(status Status, profile string, rw *response.Wrapper, r *http.Request, request stubby.Request, target *stubby.Target) {
 	if status != Recording {
 		app.logger.Debug("recordIgnored",
 			"http.method", r.Method,
@@ -129,7 +216,38 @@ func (app *application) record(status Status, rw *response.Wrapper, r *http.Requ
 		return
 	}
 
+	if errors.Is(rw.Err(), context.Canceled) {
+		app.logger.Debug("recordIgnored",
+			"http.method", r.Method,
+			"http.path", r.URL.Path,
+			"http.query", r.URL.RawQuery,
+			"error", rw.Err(),
+		)
+		app.skipRecord(r, "canceled by the client")
+		return
+	}
+
+	if ok, reason := app.shouldRecord(rw, request, target); !ok {
+		app.logger.Debug("recordSkipped",
+			"http.method", r.Method,
+			"http.path", r.URL.Path,
+			"http.query", r.URL.RawQuery,
+			"http.status_code", rw.StatusCode(),
+			"http.content_type", rw.ContentType(),
+			"reason", reason,
+		)
+		app.skipRecord(r, reason)
+		return
+	}
+
+	pending := app.queueRecord()
+
 	app.backgroundTask(r, func() error {
+		var queued *stubby.Record
+		defer func() {
+			pending <- queued
+		}()
+
 		app.logger.Debug("recordingResponse",
 			"http.method", r.Method,
 			"http.path", r.URL.Path,
@@ -140,29 +258,36 @@ func (app *application) record(status Status, rw *response.Wrapper, r *http.Requ
 			"http.content_type", rw.ContentType(),
 		)
 
-		body, err := rw.Body()
-		if err != nil {
-			return fmt.Errorf("failed to response body: %w", err)
-		}
-
 		record := stubby.Record{
-			Profile: app.profile,
-			Request: stubby.Request{
-				Host:     r.URL.Host,
-				Pathname: r.URL.Path,
-				Method:   r.Method,
-				Query:    response.QueryToJSON(r.URL.Query()),
-			},
+			Profile: profile,
+			Request: request,
 			Response: stubby.Response{
 				StatusCode: rw.StatusCode(),
-				Body:       body,
 			},
 		}
 
-		app.recordsLock.Lock()
-		app.records = append(app.records, &record)
-		app.recordsLock.Unlock()
-		app.wg.Add(1)
+		if err := rw.Err(); err != nil {
+			record.Response.Failure = stubby.NewFailure(err)
+		} else if contentType := rw.Header().Get(response.HeaderContentType); stubby.IsGRPC(contentType) {
+			grpc, err := app.recordGRPC(contentType, rw, request)
+			if err != nil {
+				app.skipRecord(r, err.Error())
+				return err
+			}
+			record.Response.GRPC = grpc
+		} else {
+			body, err := rw.Body()
+			if err != nil {
+				err = fmt.Errorf("failed to response body: %w", err)
+				app.skipRecord(r, err.Error())
+				return err
+			}
+			record.Response.Body = body
+		}
+
+		app.config.redactor.Redact(&record)
+
+		queued = &record
 
 		app.logger.Debug("responseRecorded",
 			"http.method", r.Method,
@@ -178,17 +303,93 @@ func (app *application) record(status Status, rw *response.Wrapper, r *http.Requ
 	})
 }
 
+// shouldRecord applies the record filter of the configuration file. With the
+// firstOnly option, only the first response of every request key is recorded.
+func (app *application) shouldRecord(rw *response.Wrapper, request stubby.Request, target *stubby.Target) (bool, string) {
+	filter := app.config.recordFilter
+
+	ok, reason := filter.Allows(stubby.Exchange{
+		Method:      request.Method,
+		Path:        request.Pathname,
+		Target:      target.Prefix,
+		StatusCode:  rw.StatusCode(),
+		ContentType: rw.Header().Get(response.HeaderContentType),
+	})
+	if !ok || filter == nil || !filter.FirstOnly {
+		return ok, reason
+	}
+
+	key, err := stubby.Key(&stubby.Record{Request: request})
+	if err != nil {
+		return true, ""
+	}
+
+	app.recordsLock.Lock()
+	defer app.recordsLock.Unlock()
+
+	if _, ok := app.recordedKeys[key]; ok {
+		return false, "already recorded"
+	}
+	app.recordedKeys[key] = struct{}{}
+
+	return true, ""
+}
+
+func (app *application) recordGRPC(contentType string, rw *response.Wrapper, request stubby.Request) (*stubby.GRPC, error) {
+	grpc, err := stubby.NewGRPC(contentType, rw.Bytes(), rw.Header())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grpc response: %w", err)
+	}
+
+	if app.descriptors != nil {
+		err = app.descriptors.DecodeResponse(request.Pathname, grpc)
+		if err != nil {
+			app.logger.Debug("grpcDecodeFailed", "http.path", request.Pathname, "error", err)
+		}
+	}
+
+	return grpc, nil
+}
+
 func (app *application) replay(status Status, w http.ResponseWriter, r *http.Request) bool {
 	if status != Replaying {
 		return false
 	}
 
-	record, ok := app.matcher.Match(r)
+	app.statusLock.RLock()
+	matcher := app.matcher
+	app.statusLock.RUnlock()
+	if matcher == nil {
+		return false
+	}
+
+	record, ok := matcher.Match(r)
 	if !ok {
+		app.explainMiss(r, matcher)
 		return false
 	}
 
-	err := response.JSON(w, record.Response.StatusCode, record.Response.Body)
+	app.setStubHeaders(w, record)
+
+	if failure := record.Response.Failure; failure != nil {
+		app.replayFailure(w, r, failure)
+		app.logger.Info("failureReplayed",
+			"http.method", r.Method,
+			"http.path", r.URL.Path,
+			"http.query", r.URL.RawQuery,
+			"failure.kind", failure.Kind,
+			"stub.file", stubFile(record),
+			"stub.index", record.Index,
+		)
+		return true
+	}
+
+	var err error
+	if grpc := record.Response.GRPC; grpc != nil {
+		err = app.replayGRPC(w, record.Response.StatusCode, grpc)
+	} else {
+		err = response.JSON(w, record.Response.StatusCode, record.Response.Body)
+	}
 	if err != nil {
 		app.serverError(w, r, fmt.Errorf("failed to replay response: %w", err))
 		return true
@@ -199,12 +400,41 @@ func (app *application) replay(status Status, w http.ResponseWriter, r *http.Req
 		"http.path", r.URL.Path,
 		"http.query", r.URL.RawQuery,
 		"http.status_code", record.Response.StatusCode,
-		"stub.file", record.Filepath(),
+		"stub.file", stubFile(record),
+		"stub.index", record.Index,
 	)
 
 	return true
 }
 
+func (app *application) replayGRPC(w http.ResponseWriter, statusCode int, grpc *stubby.GRPC) error {
+	body, err := grpc.Body()
+	if err != nil {
+		return err
+	}
+
+	var trailers http.Header
+	if !grpc.IsWeb() {
+		trailers = grpc.TrailerHeader()
+	}
+
+	return response.WithTrailers(w, statusCode, grpc.ContentType, body, trailers)
+}
+
+// replayFailure reproduces the recorded transport error. Connection errors
+// close the client connection when possible, the others answer with a gateway error.
+func (app *application) replayFailure(w http.ResponseWriter, r *http.Request, failure *stubby.Failure) {
+	if failure.ClosesConnection() {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+			return
+		}
+	}
+
+	app.upstreamFailure(w, r, failure)
+}
+
 func (app *application) currentProfile(r *http.Request) (string, error) {
 	profile := flow.Param(r.Context(), "profile")
 	if profile == "" {
@@ -214,33 +444,67 @@ func (app *application) currentProfile(r *http.Request) (string, error) {
 	return strings.ToLower(profile), nil
 }
 
-func (app *application) loadProfile(profile string) error {
+// loadProfile loads the stub files of the profile, skipping the invalid ones.
+// Profiles separated by `+` are loaded as layers, the last one first.
+func (app *application) loadProfile(profile string) (*stubby.Matcher, error) {
 	app.logger.Debug("loadingProfile", "profile", profile)
 
-	profilePath := filepath.Join(app.config.stubDir, profile)
-	matcher, err := stubby.NewMatcher(profilePath)
+	layers := strings.Split(profile, stubby.LayerSeparator)
+	matcher, err := stubby.NewLayeredMatcher(app.config.stubDir, layers, app.config.matcherOptions)
 	if err != nil {
-		return fmt.Errorf("failed to create stub matcher %s: %w", profilePath, err)
+		return nil, fmt.Errorf("failed to create stub matcher %s: %w", filepath.Join(app.config.stubDir, profile), err)
 	}
 
-	app.matcher = matcher
+	for _, fileErr := range matcher.Errors() {
+		app.logger.Warn("stubFileSkipped", "profile", fileErr.Profile, "stub.file", fileErr.File, "error", fileErr.Err)
+	}
 
-	return nil
+	return matcher, nil
 }
 
-func (app *application) changeStatus(status Status, profile string) {
+func fileErrors(errs []*stubby.FileError) []error {
+	converted := make([]error, len(errs))
+	for i, err := range errs {
+		converted[i] = err
+	}
+
+	return converted
+}
+
+// changeStatus returns the summary of the recording when the record mode is
+// left, once every pending record is written. The matcher is only used by the
+// replay mode.
+func (app *application) changeStatus(status Status, profile string, matcher *stubby.Matcher) *session {
 	app.logger.Info("changeStatus", "new", status, "profile", profile)
 
 	app.statusLock.Lock()
-	defer app.statusLock.Unlock()
-
+	previous := app.status
 	app.status = status
 	app.profile = strings.ToLower(profile)
+	app.matcher = matcher
+	app.statusLock.Unlock()
+
+	app.recordsLock.Lock()
+	app.recordedKeys = make(map[string]struct{})
+	app.recordsLock.Unlock()
+
+	var recording *session
+	if previous == Recording {
+		app.flushRecords()
+		recording = app.endSession()
+	}
+
+	if status == Recording {
+		app.startSession(strings.ToLower(profile))
+	}
+
+	return recording
 }
 
-func (app *application) currentStatus() Status {
+// currentStatus returns the status and the profile it applies to.
+func (app *application) currentStatus() (Status, string) {
 	app.statusLock.RLock()
 	defer app.statusLock.RUnlock()
 
-	return app.status
+	return app.status, app.profile
 }
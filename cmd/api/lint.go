@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/internal/stubby"
+)
+
+// lint validates the stub files of the given profiles, or of every profile,
+// and prints the issues found. It fails when any error is found, so it can be
+// used in CI.
+func (app *application) lint(profiles []string) error {
+	if len(profiles) == 0 {
+		var err error
+		profiles, err = app.profiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	linter, err := stubby.NewLinter()
+	if err != nil {
+		return err
+	}
+
+	var errorCount, warningCount int
+
+	for _, profile := range profiles {
+		profile = strings.ToLower(profile)
+
+		issues, err := linter.Lint(filepath.Join(app.config.stubDir, profile))
+		if err != nil {
+			return fmt.Errorf("failed to lint profile %s: %w", profile, err)
+		}
+
+		for _, issue := range issues {
+			fmt.Println(issue)
+
+			if issue.Severity == stubby.SeverityError {
+				errorCount++
+			} else {
+				warningCount++
+			}
+		}
+	}
+
+	// the findings are not a failure of the command, so they are reported
+	// without the trace of the errors
+	if errorCount > 0 {
+		app.logger.Error("profilesLintFailed", "profiles", len(profiles), "errors", errorCount, "warnings", warningCount)
+		os.Exit(1)
+	}
+
+	app.logger.Info("profilesLinted", "profiles", len(profiles), "warnings", warningCount)
+
+	return nil
+}
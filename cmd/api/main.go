@@ -12,7 +12,9 @@ import (
 	"os"
 	"runtime/debug"
 	"strings"
+	"time"
 
+	"example.com/internal/stubby"
 	"example.com/internal/version"
 )
 
@@ -39,6 +41,9 @@ func run() error {
 	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:4444", "base URL for the application")
 	flag.IntVar(&cfg.httpPort, "http-port", 4444, "port to listen on for HTTP requests")
 	flag.StringVar(&cfg.stubDir, "stub-dir", "stubs", "directory to save the stub files")
+	flag.StringVar(&cfg.descriptorSet, "descriptor-set", "", "protobuf descriptor set used to decode recorded gRPC messages")
+	flag.DurationVar(&cfg.reloadInterval, "reload-interval", time.Second, "interval to check the replayed stub files for changes, 0 to disable")
+	flag.BoolVar(&cfg.debugHeaders, "debug-headers", false, "add headers describing how every proxied request is served")
 	flag.Func("ignore-paths", "list of paths prefixes that should not be proxied (eg: /otlp/traces)", func(s string) error {
 		cfg.ignoredPaths = strings.Split(s, ",")
 		return nil
@@ -48,14 +53,18 @@ func run() error {
 		if err != nil {
 			return err
 		}
-		targets, err := parseConfig(file)
-		if err != nil {
-			return err
-		}
-		cfg.targets = targets
-		return nil
+		return cfg.load(file)
 	})
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command] [profile...]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  migrate\tmove the stubs of the profiles to the files defined by the naming strategy")
+		fmt.Fprintln(flag.CommandLine.Output(), "  lint\t\tvalidate the stub files of the profiles")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+
 	showVersion := flag.Bool("version", false, "display version and exit")
 	verbose := flag.Bool("verbose", false, "verbose")
 
@@ -73,31 +82,102 @@ func run() error {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: lvl}))
 
 	if cfg.targets == nil {
-		targets, err := parseConfig(strings.NewReader(defaultConfig))
+		err := cfg.load(strings.NewReader(defaultConfig))
 		if err != nil {
 			return err
 		}
-		cfg.targets = targets
 	}
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		proxy:  &httputil.ReverseProxy{},
+		config:        cfg,
+		logger:        logger,
+		proxy:         &httputil.ReverseProxy{Transport: newTransport()},
+		recordQueue:   make(chan pendingRecord, recordQueueSize),
+		writerStopped: make(chan struct{}),
 	}
 	app.proxy.Director = func(r *http.Request) {}
-	app.proxy.ErrorHandler = app.serverError
+	app.proxy.ErrorHandler = app.proxyError
+	app.proxy.ModifyResponse = app.modifyResponse
+
+	if cfg.descriptorSet != "" {
+		descriptors, err := stubby.LoadDescriptors(cfg.descriptorSet)
+		if err != nil {
+			return err
+		}
+		app.descriptors = descriptors
+	}
+
+	switch command := flag.Arg(0); command {
+	case "":
+		return app.serveHTTP()
+	case "migrate":
+		return app.migrate(flag.Args()[1:])
+	case "lint":
+		return app.lint(flag.Args()[1:])
+	default:
+		return fmt.Errorf("unknown command %s", command)
+	}
+}
+
+func (cfg *config) load(r io.Reader) error {
+	s, err := parseConfig(r)
+	if err != nil {
+		return err
+	}
+
+	redactor, err := stubby.NewRedactor(s.Redactions)
+	if err != nil {
+		return fmt.Errorf("failed to parse redactions: %w", err)
+	}
+
+	err = s.Recording.Compile()
+	if err != nil {
+		return fmt.Errorf("failed to parse recording filter: %w", err)
+	}
+
+	err = s.Naming.Validate()
+	if err != nil {
+		return fmt.Errorf("failed to parse naming: %w", err)
+	}
+
+	err = s.Normalization.Compile()
+	if err != nil {
+		return fmt.Errorf("failed to parse normalization: %w", err)
+	}
+
+	err = s.Placeholders.Compile()
+	if err != nil {
+		return fmt.Errorf("failed to parse placeholders: %w", err)
+	}
+
+	err = s.targets.compile()
+	if err != nil {
+		return fmt.Errorf("failed to parse targets: %w", err)
+	}
+
+	err = s.ResponseRules.Compile()
+	if err != nil {
+		return fmt.Errorf("failed to parse response rules: %w", err)
+	}
+
+	cfg.targets = &s.targets
+	cfg.redactor = redactor
+	cfg.recordFilter = s.Recording
+	cfg.naming = s.Naming
+	cfg.matcherOptions = s.MatcherOptions
+	cfg.matcherOptions.Redactor = redactor
+	cfg.responseRules = s.ResponseRules
 
-	return app.serveHTTP()
+	return nil
 }
 
-func parseConfig(r io.Reader) (*targets, error) {
-	var t targets
+func parseConfig(r io.Reader) (*settings, error) {
+	var s settings
 
-	err := json.NewDecoder(r).Decode(&t)
+	err := json.NewDecoder(r).Decode(&s)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse configuration file: %w", err)
 	}
 
-	return &t, nil
+	return &s, nil
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"example.com/internal/stubby"
+)
+
+// migrate moves the stubs of the given profiles, or of every profile, to the
+// files defined by the configured naming strategy.
+func (app *application) migrate(profiles []string) error {
+	if len(profiles) == 0 {
+		var err error
+		profiles, err = app.profiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, profile := range profiles {
+		profile = strings.ToLower(profile)
+
+		files, err := stubby.Migrate(app.config.stubDir, profile, app.config.naming)
+		if err != nil {
+			return fmt.Errorf("failed to migrate profile %s: %w", profile, err)
+		}
+
+		for file, records := range files {
+			app.logger.Debug("stubFileMigrated", "stub.file", file, "stub.records", records)
+		}
+
+		app.logger.Info("profileMigrated", "profile", profile, "files", len(files))
+	}
+
+	return nil
+}
+
+// profiles returns the name of every profile in the stub directory.
+func (app *application) profiles() ([]string, error) {
+	entries, err := os.ReadDir(app.config.stubDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", app.config.stubDir, err)
+	}
+
+	var profiles []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+
+	return profiles, nil
+}
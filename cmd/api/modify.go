@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"example.com/internal/stubby"
+)
+
+type forwardContextKey struct{}
+
+// forwarded is the state of the proxy when the request was forwarded.
+type forwarded struct {
+	status Status
+	target *stubby.Target
+}
+
+// withForwarded keeps the status and the target of the request, for the
+// response rules.
+func withForwarded(r *http.Request, status Status, target *stubby.Target) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), forwardContextKey{}, forwarded{status, target}))
+}
+
+// modifyResponse applies the response rules to the upstream response. The
+// body is forwarded unchanged when it cannot be patched. The rules are not
+// applied while recording, so the stubs contain the upstream responses.
+func (app *application) modifyResponse(resp *http.Response) error {
+	if len(app.config.responseRules) == 0 {
+		return nil
+	}
+
+	var prefix string
+	if fwd, ok := resp.Request.Context().Value(forwardContextKey{}).(forwarded); ok {
+		if fwd.status == Recording {
+			return nil
+		}
+		if fwd.target != nil {
+			prefix = fwd.target.Prefix
+		}
+	}
+
+	rules, err := app.config.responseRules.Modify(resp, prefix)
+	if err != nil {
+		app.logger.Warn("responseModificationFailed",
+			"http.method", resp.Request.Method,
+			"http.path", resp.Request.URL.Path,
+			"http.status_code", resp.StatusCode,
+			"rules", rules,
+			"error", err,
+		)
+		return nil
+	}
+
+	if len(rules) > 0 {
+		app.logger.Debug("responseModified",
+			"http.method", resp.Request.Method,
+			"http.path", resp.Request.URL.Path,
+			"http.status_code", resp.StatusCode,
+			"rules", rules,
+		)
+	}
+
+	return nil
+}
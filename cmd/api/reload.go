@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"time"
+
+	"example.com/internal/stubby"
+)
+
+// watchProfile polls the stub files of the replayed profile and reloads the
+// changed ones, until done is closed.
+func (app *application) watchProfile(done <-chan struct{}) {
+	if app.config.reloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(app.config.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			app.reloadProfile()
+		}
+	}
+}
+
+func (app *application) reloadProfile() {
+	app.statusLock.RLock()
+	status, profile, matcher := app.status, app.profile, app.matcher
+	app.statusLock.RUnlock()
+
+	if status != Replaying || matcher == nil {
+		return
+	}
+
+	changed, err := matcher.LayersChanged()
+	if err != nil {
+		app.logger.Warn("profileReloadFailed", "profile", profile, "error", err)
+		return
+	}
+	if changed {
+		app.reloadLayers(profile, matcher)
+		return
+	}
+
+	files, err := matcher.Reload()
+	if err != nil {
+		app.logger.Warn("profileReloadFailed", "profile", profile, "error", err)
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	app.logger.Info("profileReloaded", "profile", profile, "stub.files", files)
+
+	for _, fileErr := range matcher.Errors() {
+		if slices.Contains(files, filepath.Join(fileErr.Profile, fileErr.File)) {
+			app.logger.Warn("stubFileSkipped", "profile", fileErr.Profile, "stub.file", fileErr.File, "error", fileErr.Err)
+		}
+	}
+}
+
+// reloadLayers loads the profile again when its manifests extend other
+// profiles, unless another profile was replayed in the meantime. The
+// sequence of every key starts again.
+func (app *application) reloadLayers(profile string, previous *stubby.Matcher) {
+	matcher, err := app.loadProfile(profile)
+	if err != nil {
+		app.logger.Warn("profileReloadFailed", "profile", profile, "error", err)
+		return
+	}
+
+	app.statusLock.Lock()
+	replaced := app.matcher == previous
+	if replaced {
+		app.matcher = matcher
+	}
+	app.statusLock.Unlock()
+
+	if replaced {
+		app.logger.Info("profileLayersReloaded", "profile", profile)
+	}
+}
@@ -19,6 +19,8 @@ func (app *application) routes() http.Handler {
 	mux.HandleFunc("/_/record/:profile", app.recordHandler, "POST")
 	mux.HandleFunc("/_/replay/:profile", app.replayHandler, "POST")
 	mux.HandleFunc("/_/forward", app.forwardHandler, "POST")
+	mux.HandleFunc("/_/flush", app.flushHandler, "POST")
+	mux.HandleFunc("/_/explain", app.explainHandler, "POST")
 	mux.HandleFunc("/_/status", app.statusHandler, "GET")
 
 	return mux
@@ -10,6 +10,9 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
@@ -22,7 +25,7 @@ const (
 func (app *application) serveHTTP() error {
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.httpPort),
-		Handler:      app.routes(),
+		Handler:      h2c.NewHandler(app.routes(), &http2.Server{}),
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelWarn),
 		IdleTimeout:  defaultIdleTimeout,
 		ReadTimeout:  defaultReadTimeout,
@@ -30,9 +33,11 @@ func (app *application) serveHTTP() error {
 	}
 
 	shutdownErrorChan := make(chan error)
-	backgroundChan := make(chan struct{})
 
-	go app.watchRecords(backgroundChan)
+	go app.writeRecords()
+
+	stopWatching := make(chan struct{})
+	go app.watchProfile(stopWatching)
 
 	go func() {
 		quitChan := make(chan os.Signal, 1)
@@ -42,8 +47,6 @@ func (app *application) serveHTTP() error {
 		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
 		defer cancel()
 
-		backgroundChan <- struct{}{}
-
 		shutdownErrorChan <- srv.Shutdown(ctx)
 	}()
 
@@ -61,6 +64,12 @@ func (app *application) serveHTTP() error {
 
 	app.logger.Info("stopped server", slog.Group("server", "addr", srv.Addr))
 
+	close(stopWatching)
+
 	app.wg.Wait()
+
+	close(app.recordQueue)
+	<-app.writerStopped
+
 	return nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"example.com/internal/stubby"
+)
+
+type skippedRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// session summarizes a recording, from the moment the record mode is enabled
+// until it is left.
+type session struct {
+	Profile      string            `json:"profile"`
+	Files        map[string]int    `json:"files"`
+	Skipped      []*skippedRequest `json:"skipped"`
+	BytesWritten int64             `json:"bytesWritten"`
+}
+
+func (s *session) skip(method, path, reason string) {
+	for _, skipped := range s.Skipped {
+		if skipped.Method == method && skipped.Path == path && skipped.Reason == reason {
+			skipped.Count++
+			return
+		}
+	}
+
+	s.Skipped = append(s.Skipped, &skippedRequest{Method: method, Path: path, Reason: reason, Count: 1})
+}
+
+func (s *session) copy() *session {
+	c := &session{
+		Profile:      s.Profile,
+		Files:        make(map[string]int, len(s.Files)),
+		Skipped:      make([]*skippedRequest, 0, len(s.Skipped)),
+		BytesWritten: s.BytesWritten,
+	}
+
+	for file, count := range s.Files {
+		c.Files[file] = count
+	}
+
+	for _, skipped := range s.Skipped {
+		skippedCopy := *skipped
+		c.Skipped = append(c.Skipped, &skippedCopy)
+	}
+
+	sort.Slice(c.Skipped, func(i, j int) bool {
+		return c.Skipped[i].Count > c.Skipped[j].Count
+	})
+
+	return c
+}
+
+func (app *application) startSession(profile string) {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	app.session = &session{Profile: profile, Files: make(map[string]int)}
+}
+
+func (app *application) endSession() *session {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	if app.session == nil {
+		return nil
+	}
+
+	ended := app.session.copy()
+	app.session = nil
+
+	return ended
+}
+
+func (app *application) sessionSummary() *session {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	if app.session == nil {
+		return nil
+	}
+
+	return app.session.copy()
+}
+
+func (app *application) skipRecord(r *http.Request, reason string) {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	if app.session != nil {
+		app.session.skip(r.Method, r.URL.Path, reason)
+	}
+}
+
+func (app *application) recordsWritten(file string, count, bytes int) {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	if app.session != nil {
+		app.session.Files[file] += count
+		app.session.BytesWritten += int64(bytes)
+	}
+}
+
+func (app *application) recordsFailed(records []*stubby.Record, reason string) {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	if app.session != nil {
+		for _, record := range records {
+			app.session.skip(record.Request.Method, record.Request.Pathname, reason)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"example.com/internal/stubby"
+	"golang.org/x/net/http2"
+)
+
+// transport sends native gRPC calls to plain http targets over HTTP/2 without
+// TLS (h2c). Any other request goes through the default transport, which
+// negotiates HTTP/2 with https targets.
+type transport struct {
+	h2c http.RoundTripper
+}
+
+func newTransport() *transport {
+	return &transport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	contentType := r.Header.Get("Content-Type")
+	if r.URL.Scheme == "http" && stubby.IsGRPC(contentType) && !stubby.IsGRPCWeb(contentType) {
+		return t.h2c.RoundTrip(r)
+	}
+
+	return http.DefaultTransport.RoundTrip(r)
+}
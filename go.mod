@@ -2,4 +2,10 @@ module example.com
 
 go 1.21.0
 
-require github.com/alexedwards/flow v0.1.0
+require (
+	github.com/alexedwards/flow v0.1.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/net v0.30.0
+	golang.org/x/text v0.19.0
+	google.golang.org/protobuf v1.36.0
+)
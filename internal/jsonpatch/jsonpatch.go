@@ -0,0 +1,352 @@
+// Package jsonpatch applies JSON Merge Patches (RFC 7386) and JSON Patches
+// (RFC 6902) to decoded JSON documents.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+	OpMove    = "move"
+	OpCopy    = "copy"
+	OpTest    = "test"
+)
+
+// MergePatch returns the document with the merge patch applied. Null values
+// of the patch remove the members of the document.
+func MergePatch(doc, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return clone(patch)
+	}
+
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{})
+	} else {
+		object = clone(object).(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		object[key] = MergePatch(object[key], value)
+	}
+
+	return object
+}
+
+// Operation is an operation of a JSON Patch.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type Patch []Operation
+
+// Validate checks the operations and their paths, without a document.
+func (p Patch) Validate() error {
+	var errs []error
+
+	for i, operation := range p {
+		var err error
+		switch operation.Op {
+		case OpAdd, OpRemove, OpReplace, OpTest:
+			_, err = parsePointer(operation.Path)
+		case OpMove, OpCopy:
+			_, err = parsePointer(operation.Path)
+			if err == nil {
+				_, err = parsePointer(operation.From)
+			}
+		default:
+			err = fmt.Errorf("unknown op %s", operation.Op)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid operation %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply returns the document with the operations applied in order. The
+// document is not modified, and is left unchanged by a failing patch.
+func (p Patch) Apply(doc interface{}) (interface{}, error) {
+	doc = clone(doc)
+
+	for i, operation := range p {
+		var err error
+		doc, err = operation.apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+		}
+	}
+
+	return doc, nil
+}
+
+func (o Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(o.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Op {
+	case OpAdd:
+		return add(doc, path, clone(o.Value))
+	case OpRemove:
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case OpReplace:
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		doc, _, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, clone(o.Value))
+	case OpMove, OpCopy:
+		from, err := parsePointer(o.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if o.Op == OpMove {
+			if isChild(path, from) {
+				return nil, fmt.Errorf("cannot move %s into its child", o.From)
+			}
+			doc, value, err = remove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = clone(value)
+		}
+		return add(doc, path, value)
+	case OpTest:
+		value, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(value, o.Value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown op %s", o.Op)
+	}
+}
+
+// parsePointer splits a JSON pointer into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// isChild reports whether the path is below the parent path.
+func isChild(path, parent []string) bool {
+	if len(path) <= len(parent) {
+		return false
+	}
+	for i, token := range parent {
+		if path[i] != token {
+			return false
+		}
+	}
+	return true
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %s not found", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot traverse %s of a scalar value", token)
+		}
+	}
+
+	return doc, nil
+}
+
+// add sets the value at the path, inserting it in arrays, and returns the
+// new document.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		i := len(node)
+		if last != "-" {
+			i, err = index(last, len(node))
+			if err != nil {
+				return nil, err
+			}
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		return set(doc, path[:len(path)-1], node)
+	default:
+		return nil, fmt.Errorf("cannot add %s to a scalar value", last)
+	}
+}
+
+// remove deletes the value at the path, and returns the new document and the
+// removed value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("member %s not found", last)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		i, err := index(last, len(node)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[i]
+		node = append(node[:i:i], node[i+1:]...)
+		doc, err = set(doc, path[:len(path)-1], node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("cannot remove %s of a scalar value", last)
+	}
+}
+
+// set replaces the value at the path, needed when an array is resized.
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		i, err := index(last, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	}
+
+	return doc, nil
+}
+
+func index(token string, maxIndex int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > maxIndex {
+		return 0, fmt.Errorf("array index %s out of bounds", token)
+	}
+
+	return i, nil
+}
+
+// clone deep copies a decoded JSON value, so patches never share values with
+// the document.
+func clone(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = clone(item)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, item := range v {
+			array[i] = clone(item)
+		}
+		return array
+	default:
+		return v
+	}
+}
+
+// equal compares the JSON representation of the values, since numbers may be
+// decoded with different types.
+func equal(a, b interface{}) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+
+	var normalizedA, normalizedB interface{}
+	json.Unmarshal(dataA, &normalizedA)
+	json.Unmarshal(dataB, &normalizedB)
+
+	return reflect.DeepEqual(normalizedA, normalizedB)
+}
@@ -0,0 +1,265 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, data string) interface{} {
+	t.Helper()
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", data, err)
+	}
+
+	return value
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"add member", `{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`},
+		{"replace member", `{"a":1}`, `{"a":"x"}`, `{"a":"x"}`},
+		{"null deletes member", `{"a":1,"b":2}`, `{"a":null}`, `{"b":2}`},
+		{"null deletes nested member", `{"a":{"b":1,"c":2}}`, `{"a":{"b":null}}`, `{"a":{"c":2}}`},
+		{"null of missing member", `{"a":1}`, `{"b":null}`, `{"a":1}`},
+		{"array replaced", `{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{"object replaces scalar", `{"a":1}`, `{"a":{"b":null,"c":1}}`, `{"a":{"c":1}}`},
+		{"non object patch replaces document", `{"a":1}`, `[1]`, `[1]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := decode(t, tt.doc)
+
+			got := MergePatch(doc, decode(t, tt.patch))
+
+			if !equal(got, decode(t, tt.want)) {
+				data, _ := json.Marshal(got)
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+			if !equal(doc, decode(t, tt.doc)) {
+				t.Errorf("document modified")
+			}
+		})
+	}
+}
+
+func TestPatchApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		err   string
+	}{
+		{
+			name:  "add member",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/b","value":{"c":2}}]`,
+			want:  `{"a":1,"b":{"c":2}}`,
+		},
+		{
+			name:  "add replaces member",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/a","value":2}]`,
+			want:  `{"a":2}`,
+		},
+		{
+			name:  "add inserts in array",
+			doc:   `{"a":[1,3]}`,
+			patch: `[{"op":"add","path":"/a/1","value":2}]`,
+			want:  `{"a":[1,2,3]}`,
+		},
+		{
+			name:  "add appends to array",
+			doc:   `{"a":[1]}`,
+			patch: `[{"op":"add","path":"/a/-","value":2}]`,
+			want:  `{"a":[1,2]}`,
+		},
+		{
+			name:  "add replaces document",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"","value":[1]}]`,
+			want:  `[1]`,
+		},
+		{
+			name:  "add escaped member",
+			doc:   `{}`,
+			patch: `[{"op":"add","path":"/a~1b~0c","value":1}]`,
+			want:  `{"a/b~c":1}`,
+		},
+		{
+			name:  "remove member",
+			doc:   `{"a":1,"b":2}`,
+			patch: `[{"op":"remove","path":"/a"}]`,
+			want:  `{"b":2}`,
+		},
+		{
+			name:  "remove array item",
+			doc:   `{"a":[1,2,3]}`,
+			patch: `[{"op":"remove","path":"/a/1"}]`,
+			want:  `{"a":[1,3]}`,
+		},
+		{
+			name:  "replace member",
+			doc:   `{"a":{"b":1}}`,
+			patch: `[{"op":"replace","path":"/a/b","value":"x"}]`,
+			want:  `{"a":{"b":"x"}}`,
+		},
+		{
+			name:  "replace array item",
+			doc:   `[1,2,3]`,
+			patch: `[{"op":"replace","path":"/2","value":4}]`,
+			want:  `[1,2,4]`,
+		},
+		{
+			name:  "move member",
+			doc:   `{"a":{"b":1},"c":{}}`,
+			patch: `[{"op":"move","from":"/a/b","path":"/c/d"}]`,
+			want:  `{"a":{},"c":{"d":1}}`,
+		},
+		{
+			name:  "move array item",
+			doc:   `[1,2,3]`,
+			patch: `[{"op":"move","from":"/0","path":"/-"}]`,
+			want:  `[2,3,1]`,
+		},
+		{
+			name:  "copy member",
+			doc:   `{"a":{"b":[1]}}`,
+			patch: `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/-","value":2}]`,
+			want:  `{"a":{"b":[1]},"c":{"b":[1,2]}}`,
+		},
+		{
+			name:  "test passes",
+			doc:   `{"a":{"b":[1,"x"]}}`,
+			patch: `[{"op":"test","path":"/a","value":{"b":[1.0,"x"]}},{"op":"add","path":"/c","value":true}]`,
+			want:  `{"a":{"b":[1,"x"]},"c":true}`,
+		},
+		{
+			name:  "test fails",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"test","path":"/a","value":2}]`,
+			err:   "failed to apply operation 0 (test /a): test failed",
+		},
+		{
+			name:  "add index out of bounds",
+			doc:   `{"a":[1]}`,
+			patch: `[{"op":"add","path":"/a/2","value":2}]`,
+			err:   "failed to apply operation 0 (add /a/2): array index 2 out of bounds",
+		},
+		{
+			name:  "remove index out of bounds",
+			doc:   `{"a":[1]}`,
+			patch: `[{"op":"remove","path":"/a/1"}]`,
+			err:   "array index 1 out of bounds",
+		},
+		{
+			name:  "replace index out of bounds",
+			doc:   `[1]`,
+			patch: `[{"op":"replace","path":"/-","value":2}]`,
+			err:   "array index - out of bounds",
+		},
+		{
+			name:  "leading zero index",
+			doc:   `[1,2]`,
+			patch: `[{"op":"remove","path":"/01"}]`,
+			err:   `invalid array index "01"`,
+		},
+		{
+			name:  "remove missing member",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"remove","path":"/nope"}]`,
+			err:   "failed to apply operation 0 (remove /nope): member nope not found",
+		},
+		{
+			name:  "replace missing member",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"replace","path":"/b","value":2}]`,
+			err:   "member b not found",
+		},
+		{
+			name:  "move into child",
+			doc:   `{"a":{"b":1}}`,
+			patch: `[{"op":"move","from":"/a","path":"/a/c"}]`,
+			err:   "failed to apply operation 0 (move /a/c): cannot move /a into its child",
+		},
+		{
+			name:  "traverse scalar",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/a/b","value":2}]`,
+			err:   "cannot add b to a scalar value",
+		},
+		{
+			name:  "failing operation after applied ones",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/b","value":3}]`,
+			err:   "failed to apply operation 1 (test /b): test failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := decode(t, tt.doc)
+			var patch Patch
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatalf("failed to unmarshal patch: %v", err)
+			}
+
+			got, err := patch.Apply(doc)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !equal(got, decode(t, tt.want)) {
+					data, _ := json.Marshal(got)
+					t.Errorf("got %s, want %s", data, tt.want)
+				}
+			}
+			if !equal(doc, decode(t, tt.doc)) {
+				t.Errorf("document modified")
+			}
+		})
+	}
+}
+
+func TestPatchValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch Patch
+		err   string
+	}{
+		{"valid", Patch{{Op: OpAdd, Path: "/a"}, {Op: OpMove, From: "/a", Path: "/b"}}, ""},
+		{"unknown op", Patch{{Op: "merge", Path: "/a"}}, "invalid operation 0: unknown op merge"},
+		{"invalid path", Patch{{Op: OpRemove, Path: "a"}}, `invalid operation 0: invalid pointer "a"`},
+		{"invalid from", Patch{{Op: OpAdd, Path: "/a"}, {Op: OpCopy, From: "b", Path: "/a"}}, `invalid operation 1: invalid pointer "b"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.patch.Validate()
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
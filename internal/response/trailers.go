@@ -0,0 +1,24 @@
+package response
+
+import "net/http"
+
+// WithTrailers writes a raw body and sends the given trailers after it.
+func WithTrailers(w http.ResponseWriter, status int, contentType string, body []byte, trailers http.Header) error {
+	for key := range trailers {
+		w.Header().Add("Trailer", key)
+	}
+
+	w.Header().Set(HeaderContentType, contentType)
+	w.WriteHeader(status)
+
+	_, err := w.Write(body)
+	if err != nil {
+		return err
+	}
+
+	for key, values := range trailers {
+		w.Header()[key] = values
+	}
+
+	return nil
+}
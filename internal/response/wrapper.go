@@ -13,6 +13,7 @@ type Wrapper struct {
 	http.ResponseWriter
 	body       bytes.Buffer
 	statusCode int
+	err        error
 }
 
 func (rw *Wrapper) Write(b []byte) (int, error) {
@@ -29,6 +30,23 @@ func (rw *Wrapper) Header() http.Header {
 	return rw.ResponseWriter.Header()
 }
 
+func (rw *Wrapper) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *Wrapper) Bytes() []byte {
+	return rw.body.Bytes()
+}
+
+// SetError keeps the error that prevented the upstream response from being written.
+func (rw *Wrapper) SetError(err error) {
+	rw.err = err
+}
+
+func (rw *Wrapper) Err() error {
+	return rw.err
+}
+
 func (rw *Wrapper) Text() string {
 	return rw.body.String()
 }
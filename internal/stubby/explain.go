@@ -0,0 +1,254 @@
+package stubby
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const maxCandidates = 3
+
+// Explanation describes how a request is matched: the keys looked up in
+// every layer, the stub served when one is found, and the closest stubs
+// otherwise.
+type Explanation struct {
+	Matched    bool         `json:"matched"`
+	Steps      []Step       `json:"steps"`
+	Stub       *Candidate   `json:"stub,omitempty"`
+	Candidates []*Candidate `json:"candidates,omitempty"`
+}
+
+// Step is a key looked up to match the request.
+type Step struct {
+	Profile string `json:"profile,omitempty"`
+	Lookup  string `json:"lookup"`
+	Key     string `json:"key"`
+	Found   bool   `json:"found"`
+}
+
+// Candidate is a stub, with the fields that differ from the request.
+type Candidate struct {
+	Profile     string       `json:"profile,omitempty"`
+	File        string       `json:"file"`
+	Index       int          `json:"index"`
+	Request     Request      `json:"request"`
+	Differences []Difference `json:"differences,omitempty"`
+	score       int
+}
+
+type Difference struct {
+	Field   string `json:"field"`
+	Stub    string `json:"stub"`
+	Request string `json:"request"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Explain matches the request without counting the match, so the sequence
+// of the stubs does not change.
+func (m *Matcher) Explain(r *http.Request) *Explanation {
+	explanation := &Explanation{}
+
+	for layer := m; layer != nil; layer = layer.fallback {
+		if layer.explain(r, explanation) {
+			return explanation
+		}
+	}
+
+	explanation.Candidates = m.candidates(r)
+
+	return explanation
+}
+
+func (m *Matcher) explain(r *http.Request, explanation *Explanation) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, l := range m.lookups(r) {
+		records, ok := m.records[l.key]
+		explanation.Steps = append(explanation.Steps, Step{Profile: m.profile, Lookup: l.kind, Key: l.key, Found: ok})
+
+		if ok {
+			record := records[min(len(records)-1, m.matches[l.key])]
+			explanation.Matched = true
+			explanation.Stub = &Candidate{Profile: record.Profile, File: record.File, Index: record.Index, Request: record.Request}
+			return true
+		}
+	}
+
+	return false
+}
+
+// candidates returns the stubs of every layer closest to the request.
+func (m *Matcher) candidates(r *http.Request) []*Candidate {
+	graphQL, _ := ParseGraphQL(r)
+
+	var rawForm string
+	if form, ok := ParseForm(r); ok {
+		m.options.Redactor.RedactRequest(&Request{Form: form})
+		rawForm, _ = formToString(form)
+	}
+	m.options.Redactor.RedactRequest(&Request{GraphQL: graphQL})
+
+	var candidates []*Candidate
+
+	for layer := m; layer != nil; layer = layer.fallback {
+		layer.lock.Lock()
+		for _, fileName := range layer.files {
+			for _, record := range layer.contents[fileName] {
+				candidates = append(candidates, layer.compare(record, r, graphQL, rawForm))
+			}
+		}
+		layer.lock.Unlock()
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score < candidates[j].score
+	})
+
+	return candidates[:min(len(candidates), maxCandidates)]
+}
+
+// compare lists the fields of the stub that differ from the request. The
+// score weights the differences, so stubs of the same path come first.
+func (m *Matcher) compare(record *Record, r *http.Request, graphQL *GraphQL, rawForm string) *Candidate {
+	candidate := &Candidate{Profile: record.Profile, File: record.File, Index: record.Index, Request: record.Request}
+	stub := record.Request
+
+	addDifference := func(field, stubValue, requestValue, hint string, weight int) {
+		candidate.Differences = append(candidate.Differences, Difference{Field: field, Stub: stubValue, Request: requestValue, Hint: hint})
+		candidate.score += weight
+	}
+
+	if host := m.stubHost(stub.Host); host != wildcardHost && host != m.alias(r.URL.Host) {
+		addDifference("host", stub.Host, r.URL.Host, "", 1)
+	}
+
+	if stub.Method != r.Method {
+		hint := ""
+		if strings.EqualFold(stub.Method, r.Method) {
+			hint = "differs by case"
+		}
+		addDifference("method", stub.Method, r.Method, hint, 2)
+	}
+
+	pathname := m.stubPathname(r.URL.Path)
+	templatePathname := m.stubPathname(m.options.Placeholders.Pathname(pathname))
+	if stubPathname := m.stubPathname(stub.Pathname); stubPathname != pathname && stubPathname != templatePathname {
+		if hint := pathHint(stub.Pathname, r.URL.Path); hint != "" {
+			addDifference("pathname", stub.Pathname, r.URL.Path, hint, 1)
+		} else {
+			addDifference("pathname", stub.Pathname, r.URL.Path, "", 4)
+		}
+	}
+
+	if stub.Query != nil {
+		rawQuery, _ := mapToString(stub.Query)
+		requestQuery := m.options.Redactor.RedactValues(r.URL.Query())
+		templateQuery := m.options.Redactor.RedactValues(m.options.Placeholders.Values(r.URL.Query()))
+		if rawQuery != requestQuery.Encode() && rawQuery != templateQuery.Encode() {
+			stubQuery, _ := url.ParseQuery(rawQuery)
+			addDifference("query", rawQuery, requestQuery.Encode(), valuesHint(stubQuery, requestQuery), 1)
+		}
+	}
+
+	if stub.Form != nil {
+		stubForm, _ := formToString(stub.Form)
+		if stubForm != rawForm {
+			stubValues, _ := url.ParseQuery(stubForm)
+			requestValues, _ := url.ParseQuery(rawForm)
+			addDifference("form", stubForm, rawForm, valuesHint(stubValues, requestValues), 1)
+		}
+	}
+
+	if stub.GraphQL != nil {
+		switch {
+		case graphQL == nil:
+			addDifference("graphql.operationName", stub.GraphQL.OperationName, "", "the request is not a GraphQL request", 2)
+		case stub.GraphQL.OperationName != graphQL.OperationName:
+			addDifference("graphql.operationName", stub.GraphQL.OperationName, graphQL.OperationName, "", 2)
+		case !stub.GraphQL.matchesVariables(graphQL.Variables):
+			addDifference("graphql.variables", stub.GraphQL.VariablesHash(), graphQL.VariablesHash(), "the stub variables are not a subset of the request variables", 1)
+		}
+	}
+
+	return candidate
+}
+
+// pathNormalizations are the differences between two paths reported as
+// hints, when the paths are the same without them.
+var pathNormalizations = []struct {
+	hint      string
+	normalize func(string) string
+}{
+	{"case", strings.ToLower},
+	{"a trailing slash", func(p string) string {
+		if p == "/" {
+			return p
+		}
+		return strings.TrimSuffix(p, "/")
+	}},
+	{"duplicate slashes or dot segments", func(p string) string {
+		cleaned := path.Clean(p)
+		if strings.HasSuffix(p, "/") && cleaned != "/" {
+			return cleaned + "/"
+		}
+		return cleaned
+	}},
+	{"percent-encoding", func(p string) string {
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			return unescaped
+		}
+		return p
+	}},
+}
+
+func pathHint(stub, request string) string {
+	normalize := func(p string, skip int) string {
+		for i := len(pathNormalizations) - 1; i >= 0; i-- {
+			if i != skip {
+				p = pathNormalizations[i].normalize(p)
+			}
+		}
+		return p
+	}
+
+	if normalize(stub, -1) != normalize(request, -1) {
+		return ""
+	}
+
+	var hints []string
+	for i, normalization := range pathNormalizations {
+		if normalize(stub, i) != normalize(request, i) {
+			hints = append(hints, normalization.hint)
+		}
+	}
+
+	return "differs by " + strings.Join(hints, ", ")
+}
+
+// valuesHint lists the keys missing, unexpected or with different values in
+// the request.
+func valuesHint(stub, request url.Values) string {
+	var hints []string
+
+	for key, values := range stub {
+		if !request.Has(key) {
+			hints = append(hints, "missing "+key)
+		} else if !slices.Equal(values, request[key]) {
+			hints = append(hints, "different "+key)
+		}
+	}
+
+	for key := range request {
+		if !stub.Has(key) {
+			hints = append(hints, "unexpected "+key)
+		}
+	}
+
+	sort.Strings(hints)
+
+	return strings.Join(hints, ", ")
+}
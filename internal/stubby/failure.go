@@ -0,0 +1,64 @@
+package stubby
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	FailureDNS               = "dns"
+	FailureConnectionRefused = "connection_refused"
+	FailureConnectionReset   = "connection_reset"
+	FailureTimeout           = "timeout"
+	FailureTLS               = "tls"
+	FailureUnknown           = "unknown"
+)
+
+// Failure describes a transport error returned while forwarding the request,
+// when the target could not send any response.
+type Failure struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func NewFailure(err error) *Failure {
+	return &Failure{Kind: failureKind(err), Message: err.Error()}
+}
+
+// ClosesConnection reports if the failure is replayed by closing the client
+// connection instead of sending an error response.
+func (f *Failure) ClosesConnection() bool {
+	return f.Kind == FailureConnectionRefused || f.Kind == FailureConnectionReset
+}
+
+func failureKind(err error) string {
+	var (
+		dnsErr         *net.DNSError
+		netErr         net.Error
+		recordErr      tls.RecordHeaderError
+		verifyErr      *tls.CertificateVerificationError
+		authorityErr   x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		certificateErr x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return FailureDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return FailureConnectionReset
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.As(err, &recordErr), errors.As(err, &verifyErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &certificateErr):
+		return FailureTLS
+	default:
+		return FailureUnknown
+	}
+}
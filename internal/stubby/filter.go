@@ -0,0 +1,204 @@
+package stubby
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Exchange describes a forwarded request and its response, as seen by the
+// record filter.
+type Exchange struct {
+	Method      string
+	Path        string
+	Target      string
+	StatusCode  int
+	ContentType string
+}
+
+// RecordRule matches an exchange when all of its defined fields match.
+type RecordRule struct {
+	Methods     []string `json:"methods,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	PathRegex   string   `json:"pathRegex,omitempty"`
+	Target      string   `json:"target,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+
+	pathRegex *regexp.Regexp
+	minStatus int
+	maxStatus int
+}
+
+// RecordFilter selects the exchanges saved in record mode. When there are
+// include rules, an exchange must match one of them, and it must not match
+// any exclude rule.
+type RecordFilter struct {
+	Include     []*RecordRule `json:"include,omitempty"`
+	Exclude     []*RecordRule `json:"exclude,omitempty"`
+	FirstOnly   bool          `json:"firstOnly,omitempty"`
+	Deduplicate Deduplication `json:"deduplicate,omitempty"`
+}
+
+func (f *RecordFilter) Deduplication() Deduplication {
+	if f == nil {
+		return DeduplicateOff
+	}
+	return f.Deduplicate
+}
+
+func (f *RecordFilter) Compile() error {
+	if f == nil {
+		return nil
+	}
+
+	var errs []error
+
+	switch f.Deduplicate {
+	case DeduplicateOff, DeduplicateSkip, DeduplicateCount:
+	default:
+		errs = append(errs, fmt.Errorf("unknown deduplicate mode %s", f.Deduplicate))
+	}
+
+	for i, rule := range f.Include {
+		if err := rule.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid include rule %d: %w", i, err))
+		}
+	}
+
+	for i, rule := range f.Exclude {
+		if err := rule.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid exclude rule %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Allows reports if the exchange should be recorded, and why not otherwise.
+func (f *RecordFilter) Allows(e Exchange) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+
+	if len(f.Include) > 0 {
+		included := false
+		for _, rule := range f.Include {
+			if rule.matches(e) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false, "not included"
+		}
+	}
+
+	for i, rule := range f.Exclude {
+		if rule.matches(e) {
+			return false, fmt.Sprintf("excluded by rule %d", i)
+		}
+	}
+
+	return true, ""
+}
+
+func (rule *RecordRule) compile() error {
+	if rule.PathRegex != "" {
+		regex, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return err
+		}
+		rule.pathRegex = regex
+	}
+
+	if rule.Path != "" {
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("invalid path glob %s: %w", rule.Path, err)
+		}
+	}
+
+	if rule.Status != "" {
+		minStatus, maxStatus, err := parseStatusRange(rule.Status)
+		if err != nil {
+			return err
+		}
+		rule.minStatus, rule.maxStatus = minStatus, maxStatus
+	}
+
+	return nil
+}
+
+func (rule *RecordRule) matches(e Exchange) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, e.Method) {
+		return false
+	}
+
+	if rule.Path != "" {
+		if ok, _ := path.Match(rule.Path, e.Path); !ok {
+			return false
+		}
+	}
+
+	if rule.pathRegex != nil && !rule.pathRegex.MatchString(e.Path) {
+		return false
+	}
+
+	if rule.Target != "" && rule.Target != e.Target {
+		return false
+	}
+
+	if rule.Status != "" && (e.StatusCode < rule.minStatus || e.StatusCode > rule.maxStatus) {
+		return false
+	}
+
+	if rule.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(e.ContentType)
+		if !strings.HasPrefix(mediaType, rule.ContentType) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseStatusRange accepts a status code (304), a class (5xx) or a range (200-299).
+func parseStatusRange(status string) (int, int, error) {
+	if class, ok := strings.CutSuffix(strings.ToLower(status), "xx"); ok {
+		n, err := strconv.Atoi(class)
+		if err != nil || n < 1 || n > 5 {
+			return 0, 0, fmt.Errorf("invalid status class %s", status)
+		}
+		return n * 100, n*100 + 99, nil
+	}
+
+	from, to, isRange := strings.Cut(status, "-")
+	minStatus, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid status %s", status)
+	}
+
+	if !isRange {
+		return minStatus, minStatus, nil
+	}
+
+	maxStatus, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || maxStatus < minStatus {
+		return 0, 0, fmt.Errorf("invalid status range %s", status)
+	}
+
+	return minStatus, maxStatus, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
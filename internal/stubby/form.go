@@ -0,0 +1,170 @@
+package stubby
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// FilePart describes a file sent in a multipart form, the content itself is
+// not saved in the stub.
+type FilePart struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// ParseForm parses urlencoded and multipart request bodies into their fields.
+// The request body is restored, so the request can still be forwarded.
+func ParseForm(r *http.Request) (map[string]interface{}, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, false
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		body, err := readBody(r)
+		if err != nil {
+			return nil, false
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, false
+		}
+		return valuesToMap(values), true
+	case "multipart/form-data":
+		body, err := readBody(r)
+		if err != nil {
+			return nil, false
+		}
+		form, err := parseMultipart(body, params["boundary"])
+		if err != nil {
+			return nil, false
+		}
+		return form, true
+	default:
+		return nil, false
+	}
+}
+
+func parseMultipart(body []byte, boundary string) (map[string]interface{}, error) {
+	if boundary == "" {
+		return nil, errors.New("missing multipart boundary")
+	}
+
+	fields := make(map[string][]interface{})
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = append(fields[name], string(value))
+			continue
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, part)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = append(fields[name], FilePart{
+			Filename: part.FileName(),
+			Size:     size,
+			SHA256:   hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+
+	form := make(map[string]interface{}, len(fields))
+	for name, values := range fields {
+		if len(values) == 1 {
+			form[name] = values[0]
+		} else {
+			form[name] = values
+		}
+	}
+
+	return form, nil
+}
+
+func valuesToMap(values url.Values) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if len(value) == 1 {
+			result[key] = value[0]
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// formToString encodes the form fields like a query string. Files are
+// represented by their hash, so the same file always matches.
+func formToString(input map[string]interface{}) (string, error) {
+	values := url.Values{}
+
+	for key, value := range input {
+		err := addFormValue(values, key, value)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return values.Encode(), nil
+}
+
+func addFormValue(values url.Values, key string, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		values.Add(key, v)
+	case []string:
+		for _, str := range v {
+			values.Add(key, str)
+		}
+	case []interface{}:
+		for _, item := range v {
+			err := addFormValue(values, key, item)
+			if err != nil {
+				return err
+			}
+		}
+	case FilePart:
+		values.Add(key, v.SHA256)
+	case map[string]interface{}:
+		hash, ok := v["sha256"].(string)
+		if !ok {
+			return fmt.Errorf("file part %s without sha256", key)
+		}
+		values.Add(key, hash)
+	case int, int32, int64, float64, bool:
+		values.Add(key, fmt.Sprintf("%v", v))
+	default:
+		return fmt.Errorf("unsupported value type for form field %s: %T", key, v)
+	}
+
+	return nil
+}
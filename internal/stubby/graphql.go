@@ -0,0 +1,154 @@
+package stubby
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+)
+
+// GraphQL identifies the operation of a GraphQL request, so that every
+// operation sent to the same endpoint can be recorded and matched on its own.
+type GraphQL struct {
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+const anonymousOperation = "anonymous"
+
+var (
+	operationNameRegex = regexp.MustCompile(`^\s*(?:query|mutation|subscription)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+	nameRegex          = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+)
+
+// ParseGraphQL detects a GraphQL request and extracts its operation. The
+// request body is restored, so the request can still be forwarded. A request
+// whose operation name is not a valid GraphQL name is not a GraphQL request,
+// since the name is used in the stub file names.
+func ParseGraphQL(r *http.Request) (*GraphQL, bool) {
+	var payload struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if path.Base(r.URL.Path) != "graphql" {
+			return nil, false
+		}
+		query := r.URL.Query()
+		payload.Query = query.Get("query")
+		payload.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &payload.Variables); err != nil {
+				return nil, false
+			}
+		}
+	case http.MethodPost:
+		if !hasContentType(r, "application/json") && !hasContentType(r, "application/graphql+json") {
+			return nil, false
+		}
+		body, err := readBody(r)
+		if err != nil || len(body) == 0 {
+			return nil, false
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	if payload.Query == "" {
+		return nil, false
+	}
+
+	operationName := payload.OperationName
+	if operationName != "" && !nameRegex.MatchString(operationName) {
+		return nil, false
+	}
+	if operationName == "" {
+		if matches := operationNameRegex.FindStringSubmatch(payload.Query); matches != nil {
+			operationName = matches[1]
+		} else {
+			operationName = anonymousOperation
+		}
+	}
+
+	return &GraphQL{OperationName: operationName, Variables: payload.Variables}, true
+}
+
+// VariablesHash returns a stable hash of the operation variables. Map keys are
+// sorted by the JSON encoder, so the same variables always produce the same hash.
+func (g *GraphQL) VariablesHash() string {
+	if len(g.Variables) == 0 {
+		return ""
+	}
+
+	js, err := json.Marshal(g.Variables)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:8])
+}
+
+// matchesVariables reports if every variable defined in the stub is present in
+// the request with the same value. Nested objects are compared the same way.
+func (g *GraphQL) matchesVariables(variables map[string]interface{}) bool {
+	return isSubset(g.Variables, variables)
+}
+
+func isSubset(subset, set map[string]interface{}) bool {
+	for key, expected := range subset {
+		actual, ok := set[key]
+		if !ok {
+			return false
+		}
+
+		expectedMap, isMap := expected.(map[string]interface{})
+		actualMap, isActualMap := actual.(map[string]interface{})
+		if isMap && isActualMap {
+			if !isSubset(expectedMap, actualMap) {
+				return false
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(expected, actual) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentType
+}
+
+// readBody reads the whole request body and replaces it with an in-memory
+// copy, so it can be read again by the proxy.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
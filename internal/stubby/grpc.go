@@ -0,0 +1,263 @@
+package stubby
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	frameHeaderLength = 5
+	frameCompressed   = 0x01
+	frameTrailer      = 0x80
+)
+
+// GRPC holds a gRPC or gRPC-Web response. Messages are stored as base64 frames,
+// so they can be replayed byte for byte even without a descriptor set.
+type GRPC struct {
+	ContentType string            `json:"contentType"`
+	Frames      []Frame           `json:"frames"`
+	Trailers    map[string]string `json:"trailers"`
+}
+
+type Frame struct {
+	Data       string      `json:"data"`
+	Compressed bool        `json:"compressed,omitempty"`
+	Message    interface{} `json:"message,omitempty"`
+}
+
+func IsGRPC(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "application/grpc")
+}
+
+func IsGRPCWeb(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+func isGRPCWebText(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc-web-text")
+}
+
+// NewGRPC decodes the framed body of a gRPC response. Native gRPC sends the
+// status in the HTTP trailers, while gRPC-Web sends it in a trailer frame.
+func NewGRPC(contentType string, body []byte, header http.Header) (*GRPC, error) {
+	g := &GRPC{ContentType: contentType, Trailers: make(map[string]string)}
+
+	if isGRPCWebText(contentType) {
+		decoded, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode grpc-web-text body: %w", err)
+		}
+		body = decoded
+	}
+
+	for len(body) > 0 {
+		if len(body) < frameHeaderLength {
+			return nil, errors.New("truncated grpc frame header")
+		}
+
+		flags := body[0]
+		length := int(binary.BigEndian.Uint32(body[1:frameHeaderLength]))
+		if len(body) < frameHeaderLength+length {
+			return nil, errors.New("truncated grpc frame")
+		}
+		data := body[frameHeaderLength : frameHeaderLength+length]
+		body = body[frameHeaderLength+length:]
+
+		if flags&frameTrailer != 0 {
+			g.parseTrailerFrame(data)
+			continue
+		}
+
+		g.Frames = append(g.Frames, Frame{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Compressed: flags&frameCompressed != 0,
+		})
+	}
+
+	for _, key := range []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"} {
+		value := header.Get(key)
+		if value == "" {
+			value = header.Get(http.TrailerPrefix + key)
+		}
+		if value != "" {
+			g.Trailers[strings.ToLower(key)] = value
+		}
+	}
+
+	return g, nil
+}
+
+func (g *GRPC) parseTrailerFrame(data []byte) {
+	for _, line := range strings.Split(string(data), "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			g.Trailers[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+	}
+}
+
+func (g *GRPC) IsWeb() bool {
+	return IsGRPCWeb(g.ContentType)
+}
+
+// Body encodes the recorded frames back to the wire format. For gRPC-Web the
+// trailers are appended as the last frame.
+func (g *GRPC) Body() ([]byte, error) {
+	var body bytes.Buffer
+
+	for _, frame := range g.Frames {
+		data, err := base64.StdEncoding.DecodeString(frame.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode grpc frame: %w", err)
+		}
+
+		var flags byte
+		if frame.Compressed {
+			flags |= frameCompressed
+		}
+		writeFrame(&body, flags, data)
+	}
+
+	if g.IsWeb() {
+		writeFrame(&body, frameTrailer, []byte(g.trailerBlock()))
+	}
+
+	if isGRPCWebText(g.ContentType) {
+		return []byte(base64.StdEncoding.EncodeToString(body.Bytes())), nil
+	}
+
+	return body.Bytes(), nil
+}
+
+func (g *GRPC) trailerBlock() string {
+	keys := make([]string, 0, len(g.Trailers))
+	for key := range g.Trailers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var block strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&block, "%s: %s\r\n", key, g.Trailers[key])
+	}
+
+	return block.String()
+}
+
+// TrailerHeader returns the trailers in their canonical HTTP form.
+func (g *GRPC) TrailerHeader() http.Header {
+	header := make(http.Header, len(g.Trailers))
+	for key, value := range g.Trailers {
+		header.Set(textproto.CanonicalMIMEHeaderKey(key), value)
+	}
+	return header
+}
+
+func writeFrame(w *bytes.Buffer, flags byte, data []byte) {
+	var header [frameHeaderLength]byte
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	w.Write(header[:])
+	w.Write(data)
+}
+
+// Descriptors decodes gRPC messages to JSON using a FileDescriptorSet, as
+// generated by `protoc --include_imports --descriptor_set_out`.
+type Descriptors struct {
+	files *protoregistry.Files
+}
+
+func LoadDescriptors(filePath string) (*Descriptors, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read descriptor set %s: %w", filePath, err)
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(content, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal descriptor set %s: %w", filePath, err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load descriptor set %s: %w", filePath, err)
+	}
+
+	return &Descriptors{files: files}, nil
+}
+
+// DecodeResponse adds the JSON representation of every uncompressed frame of
+// the response to the given method, eg: /package.Service/Method.
+func (d *Descriptors) DecodeResponse(fullMethod string, g *GRPC) error {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return fmt.Errorf("invalid grpc method %s", fullMethod)
+	}
+
+	descriptor, err := d.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return fmt.Errorf("unknown grpc service %s: %w", service, err)
+	}
+
+	serviceDescriptor, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return fmt.Errorf("%s is not a grpc service", service)
+	}
+
+	methodDescriptor := serviceDescriptor.Methods().ByName(protoreflect.Name(method))
+	if methodDescriptor == nil {
+		return fmt.Errorf("unknown grpc method %s", fullMethod)
+	}
+
+	for i, frame := range g.Frames {
+		if frame.Compressed {
+			continue
+		}
+
+		data, err := base64.StdEncoding.DecodeString(frame.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decode grpc frame: %w", err)
+		}
+
+		message := dynamicpb.NewMessage(methodDescriptor.Output())
+		err = proto.Unmarshal(data, message)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal grpc message: %w", err)
+		}
+
+		js, err := protojson.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal grpc message: %w", err)
+		}
+
+		var decoded interface{}
+		err = json.Unmarshal(js, &decoded)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal grpc message: %w", err)
+		}
+
+		g.Frames[i].Message = decoded
+	}
+
+	return nil
+}
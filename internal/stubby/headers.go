@@ -0,0 +1,98 @@
+package stubby
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// HeaderRules change the headers of the requests sent to a target. The
+// headers are removed first, then set and appended. The `${NAME}` references
+// of the values are expanded with the environment variables when the
+// configuration is loaded, so the secrets are not written in the
+// configuration file. Any other `$` is kept, as in `$2a$` hashes.
+type HeaderRules struct {
+	Set           map[string]string `json:"set,omitempty"`
+	Append        map[string]string `json:"append,omitempty"`
+	Remove        []string          `json:"remove,omitempty"`
+	RemoveCookies []string          `json:"removeCookies,omitempty"`
+
+	set    map[string]string
+	append map[string]string
+}
+
+var envRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func (h *HeaderRules) Compile() error {
+	if h == nil {
+		return nil
+	}
+
+	var errs []error
+	expand := func(values map[string]string) map[string]string {
+		expanded := make(map[string]string, len(values))
+		for name, value := range values {
+			expanded[name] = envRegex.ReplaceAllStringFunc(value, func(reference string) string {
+				key := envRegex.FindStringSubmatch(reference)[1]
+				env, ok := os.LookupEnv(key)
+				if !ok {
+					errs = append(errs, fmt.Errorf("undefined environment variable %s in header %s", key, name))
+				}
+				return env
+			})
+		}
+		return expanded
+	}
+
+	h.set = expand(h.Set)
+	h.append = expand(h.Append)
+
+	return errors.Join(errs...)
+}
+
+// Apply changes the headers of the request. A `*` cookie removes every cookie.
+func (h *HeaderRules) Apply(r *http.Request) {
+	if h == nil {
+		return
+	}
+
+	for _, name := range h.Remove {
+		r.Header.Del(name)
+	}
+
+	if len(h.RemoveCookies) > 0 {
+		removeCookies(r, h.RemoveCookies)
+	}
+
+	for name, value := range h.set {
+		r.Header.Set(name, value)
+	}
+
+	for name, value := range h.append {
+		r.Header.Add(name, value)
+	}
+}
+
+func removeCookies(r *http.Request, names []string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+
+	if slices.Contains(names, "*") {
+		return
+	}
+
+	var kept []string
+	for _, cookie := range cookies {
+		if !slices.Contains(names, cookie.Name) {
+			kept = append(kept, cookie.String())
+		}
+	}
+
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,331 @@
+package stubby
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema is the JSON Schema of the stub files.
+//
+//go:embed schema.json
+var Schema []byte
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Issue is a problem found in a stub file.
+type Issue struct {
+	File     string
+	Line     int
+	Severity string
+	Message  string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", i.File, i.Line, i.Severity, i.Message)
+}
+
+// Linter validates stub files against the schema and reports the stubs the
+// matcher would reject or never serve.
+type Linter struct {
+	schema *jsonschema.Schema
+}
+
+func NewLinter() (*Linter, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+
+	err := compiler.AddResource("schema.json", bytes.NewReader(Schema))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema: %w", err)
+	}
+
+	schema, err := compiler.Compile("schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile schema: %w", err)
+	}
+
+	return &Linter{schema: schema}, nil
+}
+
+// definition is the first stub of a key, used to report the same key defined
+// in another file.
+type definition struct {
+	file string
+	line int
+}
+
+// Lint validates every stub file of the profile directory, in the order used
+// by the matcher.
+func (l *Linter) Lint(dirPath string) ([]Issue, error) {
+	files, err := ProfileFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []Issue
+	definitions := make(map[string]definition)
+
+	for _, filePath := range files {
+		issues = append(issues, l.lintFile(filePath, definitions)...)
+	}
+
+	return issues, nil
+}
+
+func (l *Linter) lintFile(filePath string, definitions map[string]definition) []Issue {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return []Issue{{File: filePath, Line: 1, Severity: SeverityError, Message: err.Error()}}
+	}
+
+	lines, err := pointerLines(data)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		line := 1
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line = lineAt(data, int(syntaxErr.Offset))
+		}
+		message := fmt.Sprintf("invalid JSON: %s", err)
+		if _, backupErr := decodeFile(filePath + BackupExtension); backupErr == nil {
+			message += ", the backup file is replayed instead"
+		}
+		return []Issue{{File: filePath, Line: line, Severity: SeverityError, Message: message}}
+	}
+
+	issues, invalidStubs := l.validate(filePath, data, lines)
+
+	var content File
+	if err := json.Unmarshal(data, &content); err != nil {
+		return issues
+	}
+
+	previous := make(map[string]*Record)
+
+	for i, record := range content.Records {
+		if invalidStubs[i] || record == nil {
+			continue
+		}
+
+		pointer := fmt.Sprintf("/stubs/%d", i)
+		line := lookupLine(lines, pointer)
+		report := func(pointer, severity, format string, args ...interface{}) {
+			issues = append(issues, Issue{
+				File:     filePath,
+				Line:     lookupLine(lines, pointer),
+				Severity: severity,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		}
+
+		key, err := Key(record)
+		if err != nil {
+			report(pointer+"/request", SeverityError, "%s", err)
+			continue
+		}
+
+		request := record.Request
+		if strings.ContainsAny(request.Pathname, "?#") {
+			report(pointer+"/request/pathname", SeverityError, "unreachable stub: pathname %s contains a query or a fragment, use the query field instead", request.Pathname)
+		}
+		if strings.Contains(request.Host, "/") {
+			report(pointer+"/request/host", SeverityError, "unreachable stub: host %s must not contain a scheme or a path", request.Host)
+		}
+		if request.Method != strings.ToUpper(request.Method) {
+			report(pointer+"/request/method", SeverityWarning, "unreachable stub: method %s is not uppercase", request.Method)
+		}
+		if request.GraphQL != nil && request.Method != http.MethodGet && request.Method != http.MethodPost {
+			report(pointer+"/request/method", SeverityError, "unreachable stub: GraphQL requests are only detected for GET and POST, not %s", request.Method)
+		}
+
+		if last, ok := previous[key]; ok && sameExchange(last, record) {
+			report(pointer, SeverityWarning, "duplicate of the previous stub with the same key, use repeat instead")
+		}
+		previous[key] = record
+
+		if first, ok := definitions[key]; !ok {
+			definitions[key] = definition{file: filePath, line: line}
+		} else if first.file != filePath {
+			report(pointer, SeverityWarning, "key is also defined in %s:%d, this stub is served only after the stubs of that file", first.file, first.line)
+		}
+	}
+
+	return issues
+}
+
+// validate validates the file against the schema, and returns the issues
+// and the index of the invalid stubs.
+func (l *Linter) validate(filePath string, data []byte, lines map[string]int) ([]Issue, map[int]bool) {
+	var instance interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&instance); err != nil {
+		return []Issue{{File: filePath, Line: 1, Severity: SeverityError, Message: fmt.Sprintf("invalid JSON: %s", err)}}, nil
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if err := l.schema.Validate(instance); !errors.As(err, &validationErr) {
+		return nil, nil
+	}
+
+	var issues []Issue
+	invalidStubs := make(map[int]bool)
+	seen := make(map[string]bool)
+
+	for _, cause := range leafErrors(validationErr) {
+		location := cause.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+
+		message := fmt.Sprintf("%s: %s", location, cause.Message)
+		if seen[message] {
+			continue
+		}
+		seen[message] = true
+
+		issues = append(issues, Issue{
+			File:     filePath,
+			Line:     lookupLine(lines, cause.InstanceLocation),
+			Severity: SeverityError,
+			Message:  message,
+		})
+
+		if index, ok := stubIndex(cause.InstanceLocation); ok {
+			invalidStubs[index] = true
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Line < issues[j].Line
+	})
+
+	return issues, invalidStubs
+}
+
+func leafErrors(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+
+	var leaves []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		leaves = append(leaves, leafErrors(cause)...)
+	}
+
+	return leaves
+}
+
+func stubIndex(pointer string) (int, bool) {
+	rest, ok := strings.CutPrefix(pointer, "/stubs/")
+	if !ok {
+		return 0, false
+	}
+
+	segment, _, _ := strings.Cut(rest, "/")
+	index, err := strconv.Atoi(segment)
+
+	return index, err == nil
+}
+
+// lookupLine returns the line of the value at the JSON pointer, or of its
+// closest parent.
+func lookupLine(lines map[string]int, pointer string) int {
+	for {
+		if line, ok := lines[pointer]; ok {
+			return line
+		}
+
+		i := strings.LastIndex(pointer, "/")
+		if i < 0 {
+			return 1
+		}
+		pointer = pointer[:i]
+	}
+}
+
+// pointerLines maps the JSON pointer of every value of the document to its
+// line. The line of an object member is the line of its name.
+func pointerLines(data []byte) (map[string]int, error) {
+	lines := make(map[string]int)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	line := lineAt(data, nextToken(data, 0))
+	err := walkValue(decoder, data, "", line, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+func walkValue(decoder *json.Decoder, data []byte, pointer string, line int, lines map[string]int) error {
+	lines[pointer] = line
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			line := lineAt(data, nextToken(data, int(decoder.InputOffset())))
+			name, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			err = walkValue(decoder, data, pointer+"/"+escapePointer(name.(string)), line, lines)
+			if err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			line := lineAt(data, nextToken(data, int(decoder.InputOffset())))
+			err := walkValue(decoder, data, pointer+"/"+strconv.Itoa(i), line, lines)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+
+	_, err = decoder.Token()
+	return err
+}
+
+// nextToken skips the whitespaces and separators from the offset.
+func nextToken(data []byte, offset int) int {
+	for offset < len(data) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+
+	return offset
+}
+
+func lineAt(data []byte, offset int) int {
+	return bytes.Count(data[:min(offset, len(data))], []byte("\n")) + 1
+}
+
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
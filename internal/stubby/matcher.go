@@ -6,27 +6,254 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 )
 
+// Matcher keeps the valid records of every stub file of a profile, to rebuild
+// the keys when the files change.
 type Matcher struct {
-	records map[string][]*Record
-	matches map[string]int
+	lock       sync.Mutex
+	dirPath    string
+	profile    string
+	options    MatcherOptions
+	files      []string
+	overlays   []string
+	patches    map[string][]*Overlay
+	contents   map[string][]*Record
+	states     map[string]fileState
+	errors     map[string]*FileError
+	records    map[string][]*Record
+	matches    map[string]int
+	operations map[string][]*Record
+	fallback   *Matcher
+	upper      *Matcher
+	stubDir    string
+	profiles   []string
+	layers     []string
+}
+
+// wildcardHost is the host of the stubs that match any host.
+const wildcardHost = "*"
+
+// MatcherOptions changes how the requests are compared with the stubs.
+type MatcherOptions struct {
+	// HostAliases maps hosts to the host they are the same as, so stubs
+	// recorded against one environment match the requests of another one.
+	HostAliases map[string]string `json:"hostAliases"`
+	// Normalization normalizes the host and the path of the requests and
+	// of the stubs before comparing them.
+	Normalization *Normalization `json:"normalization"`
+	// Placeholders replace the generated values of the recorded requests,
+	// and of the requests matched with templated stubs.
+	Placeholders Placeholders `json:"placeholders"`
+	// Redactor redacts the values of the requests like the values of the
+	// recorded requests, so they match the redacted stubs.
+	Redactor *Redactor `json:"-"`
+}
+
+// FileError is a stub file that could not be loaded, entirely or partially.
+// The profile is only set for layered profiles.
+type FileError struct {
+	Profile string
+	File    string
+	Err     error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %s", filepath.Join(e.Profile, e.File), e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FileError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Profile string `json:"profile,omitempty"`
+		File    string `json:"file"`
+		Error   string `json:"error"`
+	}{
+		Profile: e.Profile,
+		File:    e.File,
+		Error:   e.Err.Error(),
+	})
+}
+
+// Errors returns the stub files that could not be loaded, including the ones
+// of the lower layers.
+func (m *Matcher) Errors() []*FileError {
+	m.lock.Lock()
+	var errs []*FileError
+	for _, fileName := range append(slices.Clip(m.overlays), m.files...) {
+		if err, ok := m.errors[fileName]; ok {
+			errs = append(errs, err)
+		}
+	}
+	m.lock.Unlock()
+
+	if m.fallback == nil {
+		return errs
+	}
+
+	return append(errs, m.fallback.Errors()...)
 }
 
 func (m *Matcher) Match(r *http.Request) (*Record, bool) {
-	if record, ok := m.matchKey(m.exactQueryKey(r.URL.Host, r.Method, r.URL.Path, r.URL.Query().Encode())); ok {
-		return record, true
+	m.lock.Lock()
+	record, ok := m.match(r)
+	m.lock.Unlock()
+
+	if !ok && m.fallback != nil {
+		return m.fallback.Match(r)
 	}
 
-	if record, ok := m.matchKey(m.anyQueryKey(r.URL.Host, r.Method, r.URL.Path)); ok {
-		return record, true
+	return record, ok
+}
+
+func (m *Matcher) match(r *http.Request) (*Record, bool) {
+	for _, l := range m.lookups(r) {
+		if record, ok := m.matchKey(l.key); ok {
+			return record, true
+		}
 	}
 
 	return nil, false
 }
 
+// lookup is a key looked up to match a request.
+type lookup struct {
+	kind string
+	key  string
+}
+
+// lookups returns the keys looked up for the request, in order. For GraphQL
+// requests, the stub with exactly the same variables is looked up first, then
+// the first stub whose variables are a subset of the request variables. Every
+// key is looked up for the host of the request first, then for stubs without
+// host. When the path or the query contains values replaced by placeholders,
+// the keys with the templated path, the templated query and both are looked
+// up last, so a stub can template one of them only. The values of the
+// request are redacted like the recorded requests.
+func (m *Matcher) lookups(r *http.Request) []lookup {
+	redactor := m.options.Redactor
+	pathname := m.stubPathname(r.URL.Path)
+	query := redactor.RedactValues(r.URL.Query()).Encode()
+	graphQL, isGraphQL := ParseGraphQL(r)
+
+	var rawForm string
+	form, hasForm := ParseForm(r)
+	redactor.RedactRequest(&Request{Form: form, GraphQL: graphQL})
+	if hasForm {
+		encoded, err := formToString(form)
+		hasForm = err == nil
+		rawForm = encoded
+	}
+
+	lookups := m.keyLookups(r, pathname, query, graphQL, isGraphQL, rawForm, hasForm, "")
+
+	placeholders := m.options.Placeholders
+	templatePathname := m.stubPathname(placeholders.Pathname(pathname))
+	templateQuery := redactor.RedactValues(placeholders.Values(r.URL.Query())).Encode()
+
+	templates := []struct {
+		pathname string
+		query    string
+		suffix   string
+	}{
+		{templatePathname, query, " (path template)"},
+		{pathname, templateQuery, " (query template)"},
+		{templatePathname, templateQuery, " (template)"},
+	}
+
+	seen := map[string]bool{pathname + "?" + query: true}
+	for _, t := range templates {
+		if seen[t.pathname+"?"+t.query] {
+			continue
+		}
+		seen[t.pathname+"?"+t.query] = true
+		lookups = append(lookups, m.keyLookups(r, t.pathname, t.query, graphQL, isGraphQL, rawForm, hasForm, t.suffix)...)
+	}
+
+	return lookups
+}
+
+func (m *Matcher) keyLookups(r *http.Request, pathname, rawQuery string, graphQL *GraphQL, isGraphQL bool, rawForm string, hasForm bool, suffix string) []lookup {
+	var lookups []lookup
+	method := r.Method
+	hosts := []string{m.alias(m.options.Normalization.Host(r.URL.Host)), wildcardHost}
+
+	add := func(kind string, key func(host string) string) {
+		for _, host := range hosts {
+			if host == wildcardHost {
+				lookups = append(lookups, lookup{kind: kind + " (any host)" + suffix, key: key(host)})
+			} else {
+				lookups = append(lookups, lookup{kind: kind + suffix, key: key(host)})
+			}
+		}
+	}
+
+	if isGraphQL {
+		add("graphql", func(host string) string {
+			return m.graphQLKey(host, method, pathname, graphQL.OperationName, graphQL.VariablesHash())
+		})
+
+		for _, host := range hosts {
+			for _, candidate := range m.operations[m.operationKey(host, method, pathname, graphQL.OperationName)] {
+				if candidate.Request.GraphQL.matchesVariables(graphQL.Variables) {
+					stub := candidate.Request.GraphQL
+					lookups = append(lookups, lookup{
+						kind: "graphql variables subset" + suffix,
+						key:  m.graphQLKey(host, method, pathname, stub.OperationName, stub.VariablesHash()),
+					})
+					break
+				}
+			}
+		}
+	}
+
+	queryLookups := []struct {
+		kind string
+		key  func(host string) string
+	}{
+		{"exact query", func(host string) string { return m.exactQueryKey(host, method, pathname, rawQuery) }},
+		{"any query", func(host string) string { return m.anyQueryKey(host, method, pathname) }},
+	}
+
+	for _, l := range queryLookups {
+		if hasForm {
+			add(l.kind+" and form", func(host string) string { return m.formKey(l.key(host), rawForm) })
+		}
+		add(l.kind, l.key)
+	}
+
+	return lookups
+}
+
+// alias returns the host the given host is an alias of.
+func (m *Matcher) alias(host string) string {
+	if alias, ok := m.options.HostAliases[host]; ok {
+		return alias
+	}
+
+	return host
+}
+
+// stubHost returns the host used in the keys of a stub, stubs without host
+// match any host.
+func (m *Matcher) stubHost(host string) string {
+	if host == "" || host == wildcardHost {
+		return wildcardHost
+	}
+
+	return m.alias(m.options.Normalization.Host(host))
+}
+
+func (m *Matcher) stubPathname(pathname string) string {
+	return m.options.Normalization.Pathname(pathname)
+}
+
 func (m *Matcher) matchKey(key string) (*Record, bool) {
 	if records, ok := m.records[key]; ok {
 		record := records[min(len(records)-1, m.matches[key])]
@@ -49,83 +276,255 @@ func (m *Matcher) anyQueryKey(host, method, pathname string) string {
 	return m.exactQueryKey(host, method, pathname, "*")
 }
 
-func (m *Matcher) addFile(f File) error {
-	var errs []error
+// formKey extends a query key with the form fields. Stubs without form only
+// use the query key, so they match any form.
+func (m *Matcher) formKey(queryKey, form string) string {
+	return fmt.Sprintf("%s%s#", queryKey, form)
+}
 
-	for _, record := range f.Records {
-		err := m.addRecord(record)
-		if err != nil {
-			errs = append(errs, err)
-		}
+func (m *Matcher) operationKey(host, method, pathname, operationName string) string {
+	return fmt.Sprintf("#%s#%s#%s#graphql:%s#", host, method, pathname, operationName)
+}
+
+func (m *Matcher) graphQLKey(host, method, pathname, operationName, variablesHash string) string {
+	return fmt.Sprintf("#%s#%s#%s#graphql:%s#%s#", host, method, pathname, operationName, variablesHash)
+}
+
+func (m *Matcher) addRecord(r *Record) error {
+	key, err := m.recordKey(r)
+	if err != nil {
+		return err
 	}
 
-	if len(errs) > 0 {
-		return errors.Join(errs...)
+	if graphQL := r.Request.GraphQL; graphQL != nil {
+		opKey := m.operationKey(m.stubHost(r.Request.Host), r.Request.Method, m.stubPathname(r.Request.Pathname), graphQL.OperationName)
+		m.operations[opKey] = append(m.operations[opKey], r)
 	}
 
+	m.setRecord(key, r)
+
 	return nil
 }
 
-func (m *Matcher) addRecord(r *Record) error {
+// Key returns the key used to match the record.
+func Key(r *Record) (string, error) {
+	var m Matcher
+	return m.recordKey(r)
+}
+
+func (m *Matcher) recordKey(r *Record) (string, error) {
+	if graphQL := r.Request.GraphQL; graphQL != nil {
+		return m.graphQLKey(m.stubHost(r.Request.Host), r.Request.Method, m.stubPathname(r.Request.Pathname), graphQL.OperationName, graphQL.VariablesHash()), nil
+	}
+
+	key, err := m.queryKey(r)
+	if err != nil {
+		return "", err
+	}
+
+	if r.Request.Form != nil {
+		rawForm, err := formToString(r.Request.Form)
+		if err != nil {
+			return "", err
+		}
+		key = m.formKey(key, rawForm)
+	}
+
+	return key, nil
+}
+
+func (m *Matcher) queryKey(r *Record) (string, error) {
+	host, pathname := m.stubHost(r.Request.Host), m.stubPathname(r.Request.Pathname)
+
 	if r.Request.Query == nil {
-		m.setRecord(m.anyQueryKey(r.Request.Host, r.Request.Method, r.Request.Pathname), r)
-		return nil
+		return m.anyQueryKey(host, r.Request.Method, pathname), nil
 	}
 
 	if len(r.Request.Query) == 0 {
-		m.setRecord(m.emptyQueryKey(r.Request.Host, r.Request.Method, r.Request.Pathname), r)
-		return nil
+		return m.emptyQueryKey(host, r.Request.Method, pathname), nil
 	}
 
 	rawQuery, err := mapToString(r.Request.Query)
 	if err != nil {
-		return err
+		return "", err
 	}
-	m.setRecord(m.exactQueryKey(r.Request.Host, r.Request.Method, r.Request.Pathname, rawQuery), r)
 
-	return nil
+	return m.exactQueryKey(host, r.Request.Method, pathname, rawQuery), nil
 }
 
+// setRecord adds the record as many times as it was repeated, so that
+// deduplicated records are served in the same sequence as the original ones.
 func (m *Matcher) setRecord(k string, r *Record) {
 	records := m.records[k]
-	m.records[k] = append(records, r)
+	for i := 0; i < max(r.Repeat, 1); i++ {
+		records = append(records, r)
+	}
+	m.records[k] = records
+}
+
+// NewMatcher loads every stub file of the directory. The files that cannot be
+// loaded are skipped and reported by Errors, only failing to read the
+// directory returns an error.
+func NewMatcher(dirPath string, options MatcherOptions) (*Matcher, error) {
+	matcher, err := newMatcher(dirPath, "", options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = matcher.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return matcher, nil
+}
+
+// newMatcher creates the matcher of a layer with its overlays, the stub files
+// are loaded once the layers above are known, since their overlays also
+// change the stubs of the layer.
+func newMatcher(dirPath, profile string, options MatcherOptions) (*Matcher, error) {
+	overlays, err := OverlayFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher := &Matcher{
+		dirPath:  dirPath,
+		profile:  profile,
+		options:  options,
+		contents: make(map[string][]*Record),
+		states:   make(map[string]fileState),
+		errors:   make(map[string]*FileError),
+		matches:  make(map[string]int),
+	}
+
+	matcher.loadOverlays(overlays)
+
+	return matcher, nil
 }
 
-func NewMatcher(dirPath string) (*Matcher, error) {
-	files, err := os.ReadDir(dirPath)
+func (m *Matcher) load() error {
+	files, err := ProfileFiles(m.dirPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+		return err
+	}
+
+	for _, filePath := range files {
+		fileName, _ := filepath.Rel(m.dirPath, filePath)
+		m.files = append(m.files, fileName)
+		m.loadFile(fileName)
 	}
 
-	matcher := &Matcher{records: make(map[string][]*Record), matches: make(map[string]int)}
+	m.index()
+
+	return nil
+}
+
+// loadFile reads the valid records of the stub file. When the file cannot be
+// read, the records previously loaded from it are kept. The records of the
+// backup are loaded when the file cannot be decoded, and reported as an error.
+func (m *Matcher) loadFile(fileName string) {
+	filePath := filepath.Join(m.dirPath, fileName)
+	m.states[fileName] = statFile(filePath)
+	delete(m.errors, fileName)
+
 	var errs []error
 
-	for _, fileName := range files {
-		filePath := filepath.Join(dirPath, fileName.Name())
-		file, err := os.Open(filePath)
+	content, err := ReadFile(filePath)
+	var backupErr *BackupError
+	if errors.As(err, &backupErr) {
+		errs = append(errs, err)
+	} else if err != nil {
+		m.errors[fileName] = &FileError{Profile: m.profile, File: fileName, Err: err}
+		return
+	}
+
+	var records []*Record
+	var keyErrs []error
+
+	for i, record := range content.Records {
+		_, err := m.recordKey(record)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("failed to read profile %s : %w", fileName.Name(), err))
+			keyErrs = append(keyErrs, err)
 			continue
 		}
+		record.Profile = m.profile
+		record.File = fileName
+		record.Index = i
+		records = append(records, record)
+
+		errs = append(errs, m.applyOverlays(record)...)
+	}
+
+	m.contents[fileName] = records
+
+	if len(keyErrs) > 0 {
+		errs = append([]error{fmt.Errorf("failed to add records: %w", errors.Join(keyErrs...))}, errs...)
+	}
+	if len(errs) > 0 {
+		m.errors[fileName] = &FileError{Profile: m.profile, File: fileName, Err: errors.Join(errs...)}
+	}
+}
+
+// loadOverlays reads the overlay files of the profile. The overlays of an
+// invalid file are ignored.
+func (m *Matcher) loadOverlays(filePaths []string) {
+	for _, fileName := range m.overlays {
+		delete(m.states, fileName)
+		delete(m.errors, fileName)
+	}
+	m.overlays = nil
+	m.patches = make(map[string][]*Overlay)
+
+	for _, filePath := range filePaths {
+		fileName, _ := filepath.Rel(m.dirPath, filePath)
+		m.overlays = append(m.overlays, fileName)
+		m.states[fileName] = statFile(filePath)
 
-		var fileJSON File
-		err = json.NewDecoder(file).Decode(&fileJSON)
+		overlays, err := readOverlayFile(filePath)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("failed unmarshal stub file %s : %w", fileName.Name(), err))
+			m.errors[fileName] = &FileError{Profile: m.profile, File: fileName, Err: err}
 			continue
 		}
+		m.patches[fileName] = overlays
+	}
+}
 
-		err = matcher.addFile(fileJSON)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("failed addRecord file to matcher %s : %w", fileName.Name(), err))
+// applyOverlays changes the response of the record with every overlay
+// matching it, in order. The overlays of the layer are applied first, then
+// the overlays of the layers above, so a variation can change the stubs of the
+// profiles it extends.
+func (m *Matcher) applyOverlays(record *Record) []error {
+	var errs []error
+
+	for layer := m; layer != nil; layer = layer.upper {
+		for _, fileName := range layer.overlays {
+			for i, overlay := range layer.patches[fileName] {
+				if !overlay.matches(m, record) {
+					continue
+				}
+
+				err := overlay.apply(record)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("failed to apply overlay %d of %s to stub %d: %w", i, filepath.Join(layer.profile, fileName), record.Index, err))
+				}
+			}
 		}
 	}
 
-	if len(errs) > 0 {
-		return nil, errors.Join(errs...)
-	}
+	return errs
+}
 
-	return matcher, nil
+// index rebuilds the keys from the records of every file, in order.
+func (m *Matcher) index() {
+	m.records = make(map[string][]*Record)
+	m.operations = make(map[string][]*Record)
+
+	for _, fileName := range m.files {
+		for _, record := range m.contents[fileName] {
+			m.addRecord(record)
+		}
+	}
 }
 
 func mapToString(input map[string]interface{}) (string, error) {
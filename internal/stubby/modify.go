@@ -0,0 +1,157 @@
+package stubby
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"example.com/internal/jsonpatch"
+)
+
+// ResponseRule changes the forwarded responses matching its rule. The merge
+// patch is applied to the body before the JSON Patch, and headers with a
+// null value are removed.
+type ResponseRule struct {
+	Match      RecordRule         `json:"match"`
+	StatusCode int                `json:"statusCode,omitempty"`
+	Headers    map[string]*string `json:"headers,omitempty"`
+	MergePatch interface{}        `json:"mergePatch,omitempty"`
+	Patch      jsonpatch.Patch    `json:"patch,omitempty"`
+}
+
+// ResponseRules are applied in order, every matching rule changes the
+// response.
+type ResponseRules []*ResponseRule
+
+func (rules ResponseRules) Compile() error {
+	var errs []error
+
+	for i, rule := range rules {
+		if err := rule.Match.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid match of response rule %d: %w", i, err))
+		}
+		if err := rule.Patch.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid patch of response rule %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Modify applies the rules matching the response of a request forwarded to
+// the target, and returns the indexes of the rules applied. When the body
+// cannot be patched, it is left unchanged and the error is returned, while the
+// status and the headers are still changed.
+func (rules ResponseRules) Modify(resp *http.Response, target string) ([]int, error) {
+	exchange := Exchange{
+		Method:      resp.Request.Method,
+		Path:        resp.Request.URL.Path,
+		Target:      target,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+
+	var matched []int
+	patchBody := false
+	for i, rule := range rules {
+		if rule.Match.matches(exchange) {
+			matched = append(matched, i)
+			patchBody = patchBody || rule.MergePatch != nil || len(rule.Patch) > 0
+		}
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	if patchBody {
+		if patchErr := rules.patchBody(resp, matched); patchErr != nil {
+			err = fmt.Errorf("failed to patch response body: %w", patchErr)
+		}
+	}
+
+	for _, i := range matched {
+		rule := rules[i]
+
+		if rule.StatusCode != 0 {
+			resp.StatusCode = rule.StatusCode
+			resp.Status = fmt.Sprintf("%d %s", rule.StatusCode, http.StatusText(rule.StatusCode))
+		}
+
+		for name, value := range rule.Headers {
+			if value == nil {
+				resp.Header.Del(name)
+			} else {
+				resp.Header.Set(name, *value)
+			}
+		}
+	}
+
+	return matched, err
+}
+
+// patchBody replaces the body with the patched JSON document. A gzip body is
+// decompressed, and sent without compression.
+func (rules ResponseRules) patchBody(resp *http.Response, matched []int) error {
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	// the original body is restored when the body cannot be patched
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	plain := data
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to decompress gzip body: %w", err)
+		}
+		plain, err = io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("failed to decompress gzip body: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(plain, &body); err != nil {
+		return fmt.Errorf("failed to unmarshal body to JSON: %w", err)
+	}
+
+	for _, i := range matched {
+		rule := rules[i]
+
+		if rule.MergePatch != nil {
+			body = jsonpatch.MergePatch(body, rule.MergePatch)
+		}
+
+		if len(rule.Patch) > 0 {
+			body, err = rule.Patch.Apply(body)
+			if err != nil {
+				return fmt.Errorf("failed to apply response rule %d: %w", i, err)
+			}
+		}
+	}
+
+	patched, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal body: %w", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(patched))
+	resp.ContentLength = int64(len(patched))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(patched)))
+	resp.Header.Del("Content-Encoding")
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package stubby
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	NamingLegacy = "legacy"
+	NamingFlat   = "flat"
+	NamingNested = "nested"
+
+	defaultMaxSegmentLength = 64
+	maxFileNameLength       = 200
+	segmentSeparator        = "--"
+)
+
+// Naming defines the path of the stub file of a record. The legacy strategy
+// replaces the slashes of the path by `--`, the flat strategy does the same
+// while escaping the characters that could collide or be invalid, and the
+// nested strategy creates a directory for every path segment.
+type Naming struct {
+	Strategy         string `json:"strategy,omitempty"`
+	Host             bool   `json:"host,omitempty"`
+	Method           bool   `json:"method,omitempty"`
+	MaxSegmentLength int    `json:"maxSegmentLength,omitempty"`
+}
+
+func (n *Naming) Validate() error {
+	if n == nil {
+		return nil
+	}
+
+	switch n.Strategy {
+	case "", NamingLegacy, NamingFlat, NamingNested:
+	default:
+		return fmt.Errorf("unknown naming strategy %s", n.Strategy)
+	}
+
+	if n.MaxSegmentLength < 0 {
+		return errors.New("maxSegmentLength must be positive")
+	}
+
+	return nil
+}
+
+// Filepath returns the path of the stub file, relative to the stub directory.
+func (n *Naming) Filepath(r *Record) string {
+	if n == nil || n.Strategy == "" || n.Strategy == NamingLegacy {
+		return r.Filepath()
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.ToLower(r.Request.Pathname), "/") {
+		if segment != "" {
+			segments = append(segments, n.sanitize(segment))
+		}
+	}
+	if len(segments) == 0 {
+		segments = []string{rootSegment}
+	}
+
+	var suffixes []string
+	if r.Request.GraphQL != nil {
+		suffixes = append(suffixes, n.sanitize(strings.ToLower(r.Request.GraphQL.OperationName)))
+	}
+	if n.Method {
+		suffixes = append(suffixes, n.sanitize(strings.ToLower(r.Request.Method)))
+	}
+
+	dirs := []string{r.Profile}
+	if n.Host {
+		host := r.Request.Host
+		if host == "" {
+			host = "_"
+		}
+		dirs = append(dirs, n.sanitize(strings.ToLower(host)))
+	}
+
+	var name string
+	if n.Strategy == NamingNested {
+		dirs = append(dirs, segments[:len(segments)-1]...)
+		name = strings.Join(append(segments[len(segments)-1:], suffixes...), segmentSeparator)
+	} else {
+		name = strings.Join(append(segments, suffixes...), segmentSeparator)
+	}
+
+	if len(name) > maxFileNameLength {
+		name = name[:maxFileNameLength-17] + "~" + hashSegment(name)
+	}
+
+	return filepath.Join(append(dirs, name+".json")...)
+}
+
+// sanitize percent-encodes the characters that are not allowed in file names
+// on every platform, and the dashes that could be confused with the segment
+// separator. Long segments are truncated and suffixed by their hash.
+func (n *Naming) sanitize(segment string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		case c == '-' && i > 0 && i < len(segment)-1 && segment[i-1] != '-' && segment[i+1] != '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	sanitized := b.String()
+
+	maxLength := n.MaxSegmentLength
+	if maxLength == 0 {
+		maxLength = defaultMaxSegmentLength
+	}
+
+	if len(sanitized) > maxLength && maxLength > 17 {
+		sanitized = sanitized[:maxLength-17] + "~" + hashSegment(sanitized)
+	}
+
+	return sanitized
+}
+
+func hashSegment(segment string) string {
+	sum := sha256.Sum256([]byte(segment))
+	return hex.EncodeToString(sum[:8])
+}
+
+const migratingExtension = ".migrating"
+
+// Migrate moves the records of a profile to the files defined by the naming
+// strategy, keeping their order. It returns the number of records of every
+// new file, relative to the stub directory. The old files are set aside
+// until every new file is written, and restored when one cannot be written,
+// so the records are never duplicated. Profiles whose manifest includes a
+// list of files are not migrated, since the new files would not be included.
+func Migrate(stubDir, profile string, naming *Naming) (map[string]int, error) {
+	profilePath := filepath.Join(stubDir, profile)
+
+	manifest, err := ReadManifest(profilePath)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil && len(manifest.Include) > 0 {
+		return nil, fmt.Errorf("the manifest of profile %s includes a list of files, remove it before migrating the profile", profile)
+	}
+
+	oldFiles, err := StubFiles(profilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := make(map[string]*File)
+	var newFiles []string
+
+	for _, filePath := range oldFiles {
+		content, err := ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range content.Records {
+			record.Profile = profile
+			newFile := naming.Filepath(record)
+			if _, ok := contents[newFile]; !ok {
+				contents[newFile] = &File{}
+				newFiles = append(newFiles, newFile)
+			}
+			contents[newFile].Records = append(contents[newFile].Records, record)
+		}
+	}
+
+	var moved, written []string
+	rollback := func(err error) (map[string]int, error) {
+		for _, filePath := range written {
+			os.Remove(filePath)
+		}
+		for _, filePath := range moved {
+			if renameErr := os.Rename(filePath+migratingExtension, filePath); renameErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to restore file %s: %w", filePath, renameErr))
+			}
+		}
+		return nil, err
+	}
+
+	for _, filePath := range oldFiles {
+		err := os.Rename(filePath, filePath+migratingExtension)
+		if err != nil {
+			return rollback(fmt.Errorf("failed to move file %s: %w", filePath, err))
+		}
+		moved = append(moved, filePath)
+	}
+
+	result := make(map[string]int, len(newFiles))
+	rewritten := make(map[string]bool, len(newFiles))
+
+	for _, newFile := range newFiles {
+		fullPath := filepath.Join(stubDir, newFile)
+
+		err := os.MkdirAll(filepath.Dir(fullPath), 0o700)
+		if err != nil {
+			return rollback(fmt.Errorf("failed to create directory %s: %w", filepath.Dir(fullPath), err))
+		}
+
+		err = writeFile(fullPath, contents[newFile])
+		if err != nil {
+			return rollback(err)
+		}
+
+		written = append(written, fullPath)
+		rewritten[fullPath] = true
+		result[newFile] = len(contents[newFile].Records)
+	}
+
+	var errs []error
+	for _, filePath := range oldFiles {
+		obsolete := []string{filePath + migratingExtension}
+		if !rewritten[filePath] {
+			obsolete = append(obsolete, filePath+BackupExtension)
+		}
+
+		for _, obsoletePath := range obsolete {
+			err := os.Remove(obsoletePath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("failed to remove file %s: %w", obsoletePath, err))
+			}
+		}
+	}
+
+	return result, errors.Join(errs...)
+}
@@ -0,0 +1,95 @@
+package stubby
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization defines how the host and the path of the requests are
+// normalized, in the same way when they are recorded and when they are
+// matched with the stubs.
+type Normalization struct {
+	// Unicode composes the unicode characters of the path (NFC). The path is
+	// already decoded, so it is not unescaped again.
+	Unicode bool `json:"unicode,omitempty"`
+	// CleanPath removes duplicate slashes and dot segments.
+	CleanPath bool `json:"cleanPath,omitempty"`
+	// LocalePrefix is a regular expression removed from the start of the
+	// path, such as `^/[a-z]{2}-[a-z]{2}`.
+	LocalePrefix string `json:"localePrefix,omitempty"`
+	// TrailingSlash removes the trailing slash of the path.
+	TrailingSlash bool `json:"trailingSlash,omitempty"`
+	// Lowercase lowercases the host and the path.
+	Lowercase bool `json:"lowercase,omitempty"`
+
+	localePrefix *regexp.Regexp
+}
+
+func (n *Normalization) Compile() error {
+	if n == nil || n.LocalePrefix == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(n.LocalePrefix)
+	if err != nil {
+		return fmt.Errorf("invalid localePrefix %s: %w", n.LocalePrefix, err)
+	}
+	n.localePrefix = re
+
+	return nil
+}
+
+// Host returns the normalized host.
+func (n *Normalization) Host(host string) string {
+	if n == nil || !n.Lowercase {
+		return host
+	}
+
+	return strings.ToLower(host)
+}
+
+// Pathname returns the normalized path. The steps are applied in the order
+// of the fields of the normalization.
+func (n *Normalization) Pathname(pathname string) string {
+	if n == nil {
+		return pathname
+	}
+
+	if n.Unicode {
+		pathname = norm.NFC.String(pathname)
+	}
+
+	if n.CleanPath && pathname != "" {
+		trailingSlash := strings.HasSuffix(pathname, "/")
+		pathname = path.Clean("/" + pathname)
+		if trailingSlash && pathname != "/" {
+			pathname += "/"
+		}
+	}
+
+	if n.localePrefix != nil {
+		if loc := n.localePrefix.FindStringIndex(pathname); loc != nil && loc[0] == 0 {
+			pathname = pathname[loc[1]:]
+			if !strings.HasPrefix(pathname, "/") {
+				pathname = "/" + pathname
+			}
+		}
+	}
+
+	if n.TrailingSlash && len(pathname) > 1 {
+		pathname = strings.TrimRight(pathname, "/")
+		if pathname == "" {
+			pathname = "/"
+		}
+	}
+
+	if n.Lowercase {
+		pathname = strings.ToLower(pathname)
+	}
+
+	return pathname
+}
@@ -0,0 +1,151 @@
+package stubby
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"example.com/internal/jsonpatch"
+)
+
+// OverlayExtension is the extension of the overlay files of a profile.
+const OverlayExtension = ".overlay.json"
+
+// Overlay changes the responses of the stubs matching its request when a
+// profile is loaded, so the recorded stub files stay unchanged. The merge
+// patch is applied before the JSON Patch.
+type Overlay struct {
+	Request    OverlayRequest  `json:"request"`
+	StatusCode int             `json:"statusCode,omitempty"`
+	MergePatch interface{}     `json:"mergePatch,omitempty"`
+	Patch      jsonpatch.Patch `json:"patch,omitempty"`
+}
+
+// OverlayRequest selects the stubs of an overlay. The pathname is a glob
+// pattern, and the query only has to be a subset of the stub query.
+type OverlayRequest struct {
+	Method   string                 `json:"method,omitempty"`
+	Pathname string                 `json:"pathname"`
+	Query    map[string]interface{} `json:"query,omitempty"`
+}
+
+type OverlayFile struct {
+	Overlays []*Overlay `json:"overlays"`
+}
+
+func IsOverlayFile(name string) bool {
+	return strings.HasSuffix(name, OverlayExtension) && !strings.HasPrefix(name, ".")
+}
+
+// OverlayFiles returns the overlay files of the profile directory and its
+// subdirectories, in lexical order.
+func OverlayFiles(dirPath string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(dirPath, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if filePath != dirPath && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if IsOverlayFile(entry.Name()) {
+			files = append(files, filePath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+
+	return files, nil
+}
+
+func readOverlayFile(filePath string) ([]*Overlay, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay file %s: %w", filePath, err)
+	}
+
+	var content OverlayFile
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal overlay file %s: %w", filePath, err)
+	}
+
+	var errs []error
+	for i, overlay := range content.Overlays {
+		if _, err := path.Match(overlay.Request.Pathname, ""); err != nil || overlay.Request.Pathname == "" {
+			errs = append(errs, fmt.Errorf("invalid pathname %q of overlay %d", overlay.Request.Pathname, i))
+		}
+		if _, err := mapToString(overlay.Request.Query); err != nil {
+			errs = append(errs, fmt.Errorf("invalid query of overlay %d: %w", i, err))
+		}
+		if err := overlay.Patch.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid patch of overlay %d: %w", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return content.Overlays, nil
+}
+
+func (o *Overlay) matches(m *Matcher, r *Record) bool {
+	if o.Request.Method != "" && !strings.EqualFold(o.Request.Method, r.Request.Method) {
+		return false
+	}
+
+	if ok, _ := path.Match(m.stubPathname(o.Request.Pathname), m.stubPathname(r.Request.Pathname)); !ok {
+		return false
+	}
+
+	for key, value := range o.Request.Query {
+		stubValue, ok := r.Request.Query[key]
+		if !ok {
+			return false
+		}
+
+		expected, _ := mapToString(map[string]interface{}{key: value})
+		actual, err := mapToString(map[string]interface{}{key: stubValue})
+		if err != nil || expected != actual {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (o *Overlay) apply(r *Record) error {
+	body := r.Response.Body
+
+	if o.MergePatch != nil {
+		body = jsonpatch.MergePatch(body, o.MergePatch)
+	}
+
+	if len(o.Patch) > 0 {
+		patched, err := o.Patch.Apply(body)
+		if err != nil {
+			return err
+		}
+		body = patched
+	}
+
+	r.Response.Body = body
+	if o.StatusCode != 0 {
+		r.Response.StatusCode = o.StatusCode
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package stubby
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	PatternUUID    = "uuid"
+	PatternNumeric = "numeric"
+)
+
+var placeholderPatterns = map[string]string{
+	PatternUUID:    `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	PatternNumeric: `[0-9]+`,
+}
+
+// Placeholder replaces the path segments and query values matching a
+// pattern, such as generated ids, by `{name}` when the requests are recorded,
+// so the stubs match any value. Query values are only replaced for the given
+// query keys, or for every key with `*`.
+type Placeholder struct {
+	Name    string   `json:"name"`
+	Pattern string   `json:"pattern,omitempty"`
+	Regex   string   `json:"regex,omitempty"`
+	Query   []string `json:"query,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type Placeholders []*Placeholder
+
+func (p Placeholders) Compile() error {
+	var errs []error
+
+	for i, placeholder := range p {
+		if err := placeholder.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid placeholder %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Placeholder) compile() error {
+	expr := p.Regex
+	if p.Pattern != "" {
+		builtin, ok := placeholderPatterns[p.Pattern]
+		if !ok {
+			return fmt.Errorf("unknown pattern %s", p.Pattern)
+		}
+		if expr != "" {
+			return errors.New("pattern and regex are mutually exclusive")
+		}
+		expr = builtin
+	}
+	if expr == "" {
+		return errors.New("pattern or regex is required")
+	}
+
+	if p.Name == "" {
+		p.Name = p.Pattern
+	}
+	if p.Name == "" || strings.ContainsAny(p.Name, "{}/") {
+		return fmt.Errorf("invalid name %q", p.Name)
+	}
+
+	re, err := regexp.Compile(`^(?:` + expr + `)$`)
+	if err != nil {
+		return err
+	}
+	p.re = re
+
+	return nil
+}
+
+// value returns the placeholder of the first pattern matching the whole
+// value, or the value itself. The key is empty for path segments.
+func (p Placeholders) value(key, value string) string {
+	for _, placeholder := range p {
+		if key != "" && !slices.Contains(placeholder.Query, key) && !slices.Contains(placeholder.Query, "*") {
+			continue
+		}
+		if placeholder.re != nil && placeholder.re.MatchString(value) {
+			return "{" + placeholder.Name + "}"
+		}
+	}
+
+	return value
+}
+
+// Pathname replaces the path segments matching a pattern.
+func (p Placeholders) Pathname(pathname string) string {
+	if len(p) == 0 {
+		return pathname
+	}
+
+	segments := strings.Split(pathname, "/")
+	for i, segment := range segments {
+		if segment != "" {
+			segments[i] = p.value("", segment)
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Query replaces the query values matching a pattern, in the values of a
+// recorded request.
+func (p Placeholders) Query(query map[string]interface{}) map[string]interface{} {
+	if len(p) == 0 || query == nil {
+		return query
+	}
+
+	replaced := make(map[string]interface{}, len(query))
+	for key, value := range query {
+		switch v := value.(type) {
+		case string:
+			replaced[key] = p.value(key, v)
+		case []string:
+			values := make([]string, len(v))
+			for i, item := range v {
+				values[i] = p.value(key, item)
+			}
+			replaced[key] = values
+		default:
+			replaced[key] = value
+		}
+	}
+
+	return replaced
+}
+
+// Values replaces the query values matching a pattern.
+func (p Placeholders) Values(values url.Values) url.Values {
+	if len(p) == 0 {
+		return values
+	}
+
+	replaced := make(url.Values, len(values))
+	for key, items := range values {
+		for _, item := range items {
+			replaced.Add(key, p.value(key, item))
+		}
+	}
+
+	return replaced
+}
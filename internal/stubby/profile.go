@@ -0,0 +1,223 @@
+package stubby
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// ManifestFile is the optional file describing the stub files of a profile.
+	// It is a hidden file, so it never collides with a stub file.
+	ManifestFile = ".profile.json"
+
+	// LayerSeparator separates the profiles replayed as layers, from the
+	// lowest to the uppermost one.
+	LayerSeparator = "+"
+)
+
+// Manifest lists the directories or files of the profile to load, in order.
+// Without manifest, or without include, every stub file of the profile is
+// loaded in lexical order. The profiles it extends are loaded as lower
+// layers.
+type Manifest struct {
+	Include []string `json:"include,omitempty"`
+	Extends []string `json:"extends,omitempty"`
+}
+
+// ReadManifest reads the manifest of the profile directory, and returns nil
+// when the profile does not have one.
+func ReadManifest(dirPath string) (*Manifest, error) {
+	filePath := filepath.Join(dirPath, ManifestFile)
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", filePath, err)
+	}
+
+	var manifest Manifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest %s: %w", filePath, err)
+	}
+
+	for _, include := range manifest.Include {
+		if !filepath.IsLocal(include) {
+			return nil, fmt.Errorf("invalid include %s in manifest %s: must be relative to the profile", include, filePath)
+		}
+	}
+
+	return &manifest, nil
+}
+
+// NewLayeredMatcher loads the profiles as layers, from the lowest to the
+// uppermost one, below the profiles they extend. The matcher of every layer
+// falls back to the layer below when a request does not match.
+func NewLayeredMatcher(stubDir string, profiles []string, options MatcherOptions) (*Matcher, error) {
+	layers, err := resolveLayers(stubDir, profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var matcher *Matcher
+	for _, profile := range layers {
+		layer, err := newMatcher(filepath.Join(stubDir, profile), profile, options)
+		if err != nil {
+			return nil, err
+		}
+
+		if matcher != nil {
+			matcher.upper = layer
+		}
+		layer.fallback = matcher
+		matcher = layer
+	}
+
+	for layer := matcher; layer != nil; layer = layer.fallback {
+		err := layer.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	matcher.stubDir = stubDir
+	matcher.profiles = profiles
+	matcher.layers = layers
+
+	return matcher, nil
+}
+
+// LayersChanged reports if the manifests of the profiles extend other
+// profiles than when the layered matcher was created, in which case the
+// profiles must be loaded again.
+func (m *Matcher) LayersChanged() (bool, error) {
+	if m.layers == nil {
+		return false, nil
+	}
+
+	layers, err := resolveLayers(m.stubDir, m.profiles)
+	if err != nil {
+		return false, err
+	}
+
+	return !slices.Equal(layers, m.layers), nil
+}
+
+// resolveLayers returns the profiles and the profiles they extend, from the
+// lowest to the uppermost layer. A profile extended several times is only
+// loaded once, at its lowest position.
+func resolveLayers(stubDir string, profiles []string) ([]string, error) {
+	var layers []string
+	added := make(map[string]bool)
+
+	var visit func(profile string, extending []string) error
+	visit = func(profile string, extending []string) error {
+		if !filepath.IsLocal(profile) {
+			return fmt.Errorf("invalid profile %q", profile)
+		}
+		if slices.Contains(extending, profile) {
+			return fmt.Errorf("profile %s extends itself through %s", profile, strings.Join(extending, ", "))
+		}
+		if added[profile] {
+			return nil
+		}
+
+		manifest, err := ReadManifest(filepath.Join(stubDir, profile))
+		if err != nil {
+			return err
+		}
+
+		if manifest != nil {
+			for _, extended := range manifest.Extends {
+				err := visit(strings.ToLower(extended), append(extending, profile))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		added[profile] = true
+		layers = append(layers, profile)
+
+		return nil
+	}
+
+	for _, profile := range profiles {
+		err := visit(profile, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return layers, nil
+}
+
+// ProfileFiles returns the stub files of the profile directory in the order
+// they are loaded, following the manifest when there is one.
+func ProfileFiles(dirPath string) ([]string, error) {
+	manifest, err := ReadManifest(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil || len(manifest.Include) == 0 {
+		return StubFiles(dirPath)
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+
+	for _, include := range manifest.Include {
+		included, err := StubFiles(filepath.Join(dirPath, include))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range included {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// StubFiles returns the stub files of the directory and its subdirectories,
+// in lexical order, ignoring the hidden files, such as the manifest of the
+// profile, and any file that is not a JSON file.
+func StubFiles(dirPath string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(dirPath, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if filePath != dirPath && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if IsStubFile(entry.Name()) {
+			files = append(files, filePath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+
+	return files, nil
+}
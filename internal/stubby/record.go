@@ -1,10 +1,12 @@
 package stubby
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -16,22 +18,44 @@ type Request struct {
 	Pathname string                 `json:"pathname"`
 	Method   string                 `json:"method"`
 	Query    map[string]interface{} `json:"query"`
+	Form     map[string]interface{} `json:"form,omitempty"`
+	GraphQL  *GraphQL               `json:"graphql,omitempty"`
 }
 
 type Response struct {
 	StatusCode int         `json:"statusCode"`
 	Body       interface{} `json:"body"`
+	GRPC       *GRPC       `json:"grpc,omitempty"`
+	Failure    *Failure    `json:"failure,omitempty"`
 }
 
+// Record is a stub. The stub file and the index of the stub in the file are
+// only set when the record is loaded by a matcher.
 type Record struct {
 	Profile  string   `json:"-"`
+	File     string   `json:"-"`
+	Index    int      `json:"-"`
 	Request  Request  `json:"request"`
 	Response Response `json:"response"`
+	Repeat   int      `json:"repeat,omitempty"`
 }
 
+// Filepath returns the path of the stub file of the legacy naming strategy. A
+// leading dot is escaped, since the hidden files are not stub files, the root
+// path is named rootSegment, and the operation name is escaped, since the
+// stub files may come from anywhere.
 func (r *Record) Filepath() string {
 	lowered := strings.ToLower(r.Request.Pathname)
 	normalized := strings.TrimPrefix(strings.ReplaceAll(lowered, "/", "--"), "--")
+	if strings.HasPrefix(normalized, ".") {
+		normalized = "%2E" + normalized[1:]
+	}
+	if normalized == "" {
+		normalized = rootSegment
+	}
+	if r.Request.GraphQL != nil {
+		normalized += "--" + url.PathEscape(strings.ToLower(r.Request.GraphQL.OperationName))
+	}
 	return filepath.Join(r.Profile, normalized+".json")
 }
 
@@ -39,15 +63,80 @@ type File struct {
 	Records []*Record `json:"stubs"`
 }
 
-func (f *File) add(r *Record) {
-	if r != nil {
-		f.Records = append(f.Records, r)
+// Deduplication defines what happens when a record is identical to the
+// previous record with the same key.
+type Deduplication string
+
+const (
+	DeduplicateOff   Deduplication = ""
+	DeduplicateSkip  Deduplication = "skip"
+	DeduplicateCount Deduplication = "count"
+)
+
+// add reports if the record is appended, and not deduplicated.
+func (f *File) add(r *Record, mode Deduplication) bool {
+	if r == nil {
+		return false
+	}
+
+	if mode != DeduplicateOff {
+		if previous := f.previous(r); previous != nil && sameExchange(previous, r) {
+			if mode == DeduplicateCount {
+				previous.Repeat = max(previous.Repeat, 1) + 1
+			}
+			return false
+		}
+	}
+
+	f.Records = append(f.Records, r)
+
+	return true
+}
+
+// previous returns the last record with the same key.
+func (f *File) previous(r *Record) *Record {
+	key, err := Key(r)
+	if err != nil {
+		return nil
 	}
+
+	for i := len(f.Records) - 1; i >= 0; i-- {
+		if k, err := Key(f.Records[i]); err == nil && k == key {
+			return f.Records[i]
+		}
+	}
+
+	return nil
 }
 
-func WriteToFile(filePath string, record *Record) error {
-	if record == nil {
-		return fmt.Errorf("record is null")
+// sameExchange compares the JSON representation of the records, since the
+// record read from a file and the new one may use different Go types.
+func sameExchange(a, b *Record) bool {
+	requestA, errA := json.Marshal(a.Request)
+	requestB, errB := json.Marshal(b.Request)
+	if errA != nil || errB != nil || !bytes.Equal(requestA, requestB) {
+		return false
+	}
+
+	responseA, errA := json.Marshal(a.Response)
+	responseB, errB := json.Marshal(b.Response)
+	return errA == nil && errB == nil && bytes.Equal(responseA, responseB)
+}
+
+const (
+	BackupExtension = ".bak"
+	tempExtension   = ".tmp"
+)
+
+// WriteToFile appends the records to the stub file, reading and writing the
+// file only once. The new content is written to a temporary file renamed over
+// the stub file, so a crash never leaves a truncated file, and the previous
+// content is kept in a backup file. It returns the number of records added,
+// without the deduplicated ones, and the number of bytes written to the stub
+// and backup files.
+func WriteToFile(filePath string, records []*Record, mode Deduplication) (int, int, error) {
+	if len(records) == 0 {
+		return 0, 0, fmt.Errorf("records are empty")
 	}
 
 	dirPath := path.Dir(filePath)
@@ -56,38 +145,176 @@ func WriteToFile(filePath string, record *Record) error {
 	if os.IsNotExist(err) {
 		err = os.MkdirAll(dirPath, 0o700)
 		if err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", dirPath, err)
+			return 0, 0, fmt.Errorf("failed to create directory %s: %w", dirPath, err)
+		}
+	}
+
+	previous, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, 0, fmt.Errorf("failed to read file %s: %w", filePath, err)
+	}
+
+	content, err := ReadFile(filePath)
+	var backupErr *BackupError
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.As(err, &backupErr) {
+		return 0, 0, err
+	}
+
+	added := 0
+	for _, record := range records {
+		if content.add(record, mode) {
+			added++
 		}
 	}
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	data, err := encodeFile(&content)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+		return 0, 0, err
+	}
+
+	var written int
+	if len(previous) > 0 && json.Valid(previous) {
+		err = writeAtomic(filePath+BackupExtension, previous)
+		if err != nil {
+			return 0, 0, err
+		}
+		written += len(previous)
+	}
+
+	err = writeAtomic(filePath, data)
+	if err != nil {
+		return 0, written, err
+	}
+
+	return added, written + len(data), nil
+}
+
+// BackupError is returned with the content of the backup of a stub file that
+// cannot be decoded.
+type BackupError struct {
+	Err error
+}
+
+func (e *BackupError) Error() string {
+	return fmt.Sprintf("loaded from the backup file: %s", e.Err)
+}
+
+func (e *BackupError) Unwrap() error {
+	return e.Err
+}
+
+// ReadFile decodes a stub file. When the file cannot be decoded, the backup of
+// its previous version is returned instead, with a BackupError. A missing
+// file is never replaced by its backup, since it may have been removed on
+// purpose.
+func ReadFile(filePath string) (File, error) {
+	content, err := decodeFile(filePath)
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return content, err
+	}
+
+	backup, backupErr := decodeFile(filePath + BackupExtension)
+	if backupErr == nil {
+		return backup, &BackupError{Err: err}
 	}
 
+	return File{}, err
+}
+
+func decodeFile(filePath string) (File, error) {
 	var content File
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return content, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
 	err = json.NewDecoder(file).Decode(&content)
 	if err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("failed to unmarshal file %s: %w", filePath, err)
+		return content, fmt.Errorf("failed to unmarshal file %s: %w", filePath, err)
 	}
-	content.add(record)
 
-	err = file.Truncate(0)
+	return content, nil
+}
+
+func encodeFile(content *File) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "\t")
+	err := encoder.Encode(content)
 	if err != nil {
-		return fmt.Errorf("failed to rewrite file %s: %w", filePath, err)
+		return nil, fmt.Errorf("failed to marshal new content %w", err)
 	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "\t")
-	err = encoder.Encode(content)
+	return buf.Bytes(), nil
+}
+
+// writeFile replaces the content of the stub file.
+func writeFile(filePath string, content *File) error {
+	data, err := encodeFile(content)
 	if err != nil {
-		return fmt.Errorf("failed to marshal new content %w", err)
+		return err
 	}
 
-	err = file.Close()
+	return writeAtomic(filePath, data)
+}
+
+func writeAtomic(filePath string, data []byte) error {
+	dirPath := filepath.Dir(filePath)
+
+	file, err := os.CreateTemp(dirPath, "."+filepath.Base(filePath)+".*"+tempExtension)
 	if err != nil {
-		return fmt.Errorf("failed to close file %s: %w", filePath, err)
+		return fmt.Errorf("failed to create temporary file for %s: %w", filePath, err)
+	}
+	tempPath := file.Name()
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0o644)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	}
+
+	err = os.Rename(tempPath, filePath)
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace file %s: %w", filePath, err)
+	}
+
+	if dir, err := os.Open(dirPath); err == nil {
+		dir.Sync()
+		dir.Close()
 	}
 
 	return nil
 }
+
+const (
+	stubExtension = ".json"
+
+	// rootSegment names the stub file of the root path. The sanitized
+	// segments escape the `%`, so they never produce it.
+	rootSegment = "%2F"
+)
+
+// IsStubFile reports if the file name is a stub file, and not a backup, a
+// temporary file or any other file of the profile directory. The `.json`
+// file is the stub file of the root path of older recordings, so it is not
+// ignored as a hidden file.
+func IsStubFile(name string) bool {
+	if name == stubExtension {
+		return true
+	}
+
+	return strings.HasSuffix(name, stubExtension) && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, OverlayExtension)
+}
@@ -0,0 +1,380 @@
+package stubby
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	StrategyMask = "mask"
+	StrategyHash = "hash"
+	StrategyFake = "fake"
+
+	defaultMask = "[REDACTED]"
+)
+
+var patterns = map[string]string{
+	"email":  `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"jwt":    `eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`,
+	"bearer": `(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`,
+}
+
+// Redaction replaces sensitive values of a record before it is saved. A rule
+// selects values with one of JSONPath, Query, Trailer, Pattern or Regex.
+type Redaction struct {
+	JSONPath string `json:"jsonPath,omitempty"`
+	Query    string `json:"query,omitempty"`
+	Header   string `json:"header,omitempty"`
+	Trailer  string `json:"trailer,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+	Value    string `json:"value,omitempty"`
+
+	path  jsonPath
+	regex *regexp.Regexp
+}
+
+type Redactor struct {
+	rules []*Redaction
+}
+
+func NewRedactor(rules []Redaction) (*Redactor, error) {
+	redactor := &Redactor{}
+	var errs []error
+
+	for i := range rules {
+		rule := rules[i]
+		err := rule.compile()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid redaction %d: %w", i, err))
+			continue
+		}
+		redactor.rules = append(redactor.rules, &rule)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return redactor, nil
+}
+
+func (rule *Redaction) compile() error {
+	switch rule.Strategy {
+	case "":
+		rule.Strategy = StrategyMask
+	case StrategyMask, StrategyHash, StrategyFake:
+	default:
+		return fmt.Errorf("unknown strategy %s", rule.Strategy)
+	}
+
+	if rule.Header != "" {
+		return errors.New("header is not supported, since the headers of the stubs are not recorded, use trailer for the gRPC trailers")
+	}
+
+	var err error
+
+	switch {
+	case rule.JSONPath != "":
+		rule.path, err = parseJSONPath(rule.JSONPath)
+	case rule.Pattern != "":
+		expr, ok := patterns[rule.Pattern]
+		if !ok {
+			return fmt.Errorf("unknown pattern %s", rule.Pattern)
+		}
+		rule.regex = regexp.MustCompile(expr)
+	case rule.Regex != "":
+		rule.regex, err = regexp.Compile(rule.Regex)
+	case rule.Query == "" && rule.Trailer == "":
+		return errors.New("one of jsonPath, query, trailer, pattern or regex is required")
+	}
+
+	return err
+}
+
+// Redact modifies the record in place.
+func (rd *Redactor) Redact(r *Record) {
+	if rd == nil {
+		return
+	}
+
+	rd.RedactRequest(&r.Request)
+
+	for _, rule := range rd.rules {
+		switch {
+		case rule.path != nil:
+			r.Response.Body = rule.path.apply(r.Response.Body, rule.replaceValue)
+			if r.Response.GRPC != nil {
+				for i, frame := range r.Response.GRPC.Frames {
+					r.Response.GRPC.Frames[i].Message = rule.path.apply(frame.Message, rule.replaceValue)
+				}
+			}
+		case rule.regex != nil:
+			r.Response.Body = rule.replaceMatches(r.Response.Body)
+			if r.Response.Failure != nil {
+				r.Response.Failure.Message = rule.replaceMatches(r.Response.Failure.Message).(string)
+			}
+		case rule.Trailer != "":
+			if r.Response.GRPC != nil {
+				for key, value := range r.Response.GRPC.Trailers {
+					if strings.EqualFold(key, rule.Trailer) {
+						r.Response.GRPC.Trailers[key] = rule.replacement(value)
+					}
+				}
+			}
+		}
+	}
+}
+
+// RedactRequest modifies the query, the form and the GraphQL variables of the
+// request in place. Every strategy always gives the same value for the same
+// original value, so the matcher redacts the replayed requests the same way
+// to match the redacted stubs.
+func (rd *Redactor) RedactRequest(r *Request) {
+	if rd == nil {
+		return
+	}
+
+	for _, rule := range rd.rules {
+		switch {
+		case rule.path != nil:
+			if r.GraphQL != nil {
+				r.GraphQL.Variables = rule.path.applyMap(r.GraphQL.Variables, rule.replaceValue)
+			}
+		case rule.regex != nil:
+			r.Query = rule.replaceMatches(r.Query).(map[string]interface{})
+			r.Form = rule.replaceMatches(r.Form).(map[string]interface{})
+			if r.GraphQL != nil {
+				r.GraphQL.Variables = rule.replaceMatches(r.GraphQL.Variables).(map[string]interface{})
+			}
+		case rule.Query != "":
+			rule.replaceKey(r.Query, rule.Query)
+			rule.replaceKey(r.Form, rule.Query)
+		}
+	}
+}
+
+// RedactValues returns the query values redacted like the query of a
+// recorded request.
+func (rd *Redactor) RedactValues(values url.Values) url.Values {
+	if rd == nil {
+		return values
+	}
+
+	query := make(map[string]interface{}, len(values))
+	for key, items := range values {
+		query[key] = slices.Clone(items)
+	}
+
+	request := Request{Query: query}
+	rd.RedactRequest(&request)
+
+	redacted := make(url.Values, len(request.Query))
+	for key, items := range request.Query {
+		redacted[key] = items.([]string)
+	}
+
+	return redacted
+}
+
+func (rule *Redaction) replaceKey(values map[string]interface{}, key string) {
+	if value, ok := values[key]; ok {
+		values[key] = rule.replaceValue(value)
+	}
+}
+
+func (rule *Redaction) replaceValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = rule.replaceValue(v[i])
+		}
+		return v
+	case []string:
+		for i := range v {
+			v[i] = rule.replacement(v[i])
+		}
+		return v
+	case nil:
+		return nil
+	case string:
+		return rule.replacement(v)
+	default:
+		return rule.replacement(fmt.Sprintf("%v", v))
+	}
+}
+
+// replaceMatches replaces every match of the rule regex in the strings of the value.
+func (rule *Redaction) replaceMatches(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return rule.regex.ReplaceAllStringFunc(v, rule.replacement)
+	case []string:
+		for i := range v {
+			v[i] = rule.regex.ReplaceAllStringFunc(v[i], rule.replacement)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = rule.replaceMatches(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = rule.replaceMatches(v[key])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (rule *Redaction) replacement(original string) string {
+	switch rule.Strategy {
+	case StrategyHash:
+		return "sha256:" + shortHash(original)
+	case StrategyFake:
+		if rule.Value != "" {
+			return rule.Value
+		}
+		return fakeValue(rule.Pattern, original)
+	default:
+		if rule.Value != "" {
+			return rule.Value
+		}
+		return defaultMask
+	}
+}
+
+// fakeValue generates a value with the same shape as the original one. The
+// same original always gives the same value, so relations between stubs are kept.
+func fakeValue(pattern, original string) string {
+	hash := shortHash(original)
+
+	switch pattern {
+	case "email":
+		return fmt.Sprintf("user-%s@example.com", hash)
+	case "jwt":
+		return "eyJhbGciOiJub25lIn0.eyJzdWIiOiI" + hash + "In0."
+	case "bearer":
+		return "Bearer " + hash
+	default:
+		return "fake-" + hash
+	}
+}
+
+func shortHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:6])
+}
+
+type pathSegment struct {
+	key       string
+	index     int
+	wildcard  bool
+	recursive bool
+}
+
+// jsonPath is a subset of JSONPath: `$.a.b`, `$.a[0]`, `$.a[*].b`, `$.a.*` and `$..b`.
+type jsonPath []pathSegment
+
+var indexRegex = regexp.MustCompile(`^\[(\*|\d+)\]`)
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	rest := strings.TrimPrefix(expr, "$")
+	var path jsonPath
+
+	for rest != "" {
+		var segment pathSegment
+		segment.index = -1
+
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			segment.recursive = true
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+		case indexRegex.MatchString(rest):
+			match := indexRegex.FindStringSubmatch(rest)
+			rest = rest[len(match[0]):]
+			if match[1] == "*" {
+				segment.wildcard = true
+			} else {
+				segment.index, _ = strconv.Atoi(match[1])
+			}
+			path = append(path, segment)
+			continue
+		default:
+			return nil, fmt.Errorf("invalid json path %s", expr)
+		}
+
+		end := strings.IndexAny(rest, ".[")
+		if end == -1 {
+			end = len(rest)
+		}
+		segment.key = rest[:end]
+		rest = rest[end:]
+
+		if segment.key == "" {
+			return nil, fmt.Errorf("invalid json path %s", expr)
+		}
+		if segment.key == "*" {
+			segment.key = ""
+			segment.wildcard = true
+		}
+
+		path = append(path, segment)
+	}
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty json path %s", expr)
+	}
+
+	return path, nil
+}
+
+func (p jsonPath) applyMap(value map[string]interface{}, fn func(interface{}) interface{}) map[string]interface{} {
+	if value == nil {
+		return nil
+	}
+	p.apply(value, fn)
+	return value
+}
+
+// apply calls fn with every value selected by the path and replaces it by the result.
+func (p jsonPath) apply(value interface{}, fn func(interface{}) interface{}) interface{} {
+	if len(p) == 0 {
+		return fn(value)
+	}
+
+	segment, rest := p[0], p[1:]
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if segment.wildcard || (segment.index < 0 && key == segment.key) {
+				v[key] = rest.apply(child, fn)
+			} else if segment.recursive {
+				v[key] = p.apply(child, fn)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if segment.wildcard || i == segment.index {
+				v[i] = rest.apply(child, fn)
+			} else if segment.recursive {
+				v[i] = p.apply(child, fn)
+			}
+		}
+	}
+
+	return value
+}
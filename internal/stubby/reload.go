@@ -0,0 +1,163 @@
+package stubby
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// fileState identifies the version of a stub file, to detect the changes
+// without reading it.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(filePath string) fileState {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fileState{}
+	}
+
+	return fileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+// Reload reloads the stub files of every layer added, changed or removed
+// since they were loaded, and returns their paths relative to the stub
+// directory. The sequence of the keys whose stubs did not change is kept.
+// Every stub file of the layers below a changed overlay is reloaded.
+func (m *Matcher) Reload() ([]string, error) {
+	var reloaded []string
+	var errs []error
+	overlaysChanged := false
+
+	for layer := m; layer != nil; layer = layer.fallback {
+		files, changed, err := layer.reload(overlaysChanged)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		overlaysChanged = overlaysChanged || changed
+
+		for _, file := range files {
+			reloaded = append(reloaded, filepath.Join(layer.profile, file))
+		}
+	}
+
+	return reloaded, errors.Join(errs...)
+}
+
+// reload is only called by a single goroutine, so the files and their states
+// are compared before locking the matcher. It reports if the overlays of the
+// layer changed, and reloads every stub file when the overlays of a layer
+// above changed.
+func (m *Matcher) reload(overlaysChanged bool) ([]string, bool, error) {
+	filePaths, err := ProfileFiles(m.dirPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	files := make([]string, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		fileName, _ := filepath.Rel(m.dirPath, filePath)
+		files = append(files, fileName)
+	}
+
+	overlayPaths, err := OverlayFiles(m.dirPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// every stub file is reloaded when an overlay changes
+	var changedOverlays []string
+	overlays := make([]string, 0, len(overlayPaths))
+	for _, filePath := range overlayPaths {
+		fileName, _ := filepath.Rel(m.dirPath, filePath)
+		overlays = append(overlays, fileName)
+
+		state, ok := m.states[fileName]
+		if !ok || state != statFile(filePath) {
+			changedOverlays = append(changedOverlays, fileName)
+		}
+	}
+	for _, fileName := range m.overlays {
+		if !slices.Contains(overlays, fileName) {
+			changedOverlays = append(changedOverlays, fileName)
+		}
+	}
+
+	var changed []string
+	for _, fileName := range files {
+		if overlaysChanged || len(changedOverlays) > 0 {
+			changed = append(changed, fileName)
+			continue
+		}
+
+		state, ok := m.states[fileName]
+		if !ok || state != statFile(filepath.Join(m.dirPath, fileName)) {
+			changed = append(changed, fileName)
+		}
+	}
+	for _, fileName := range m.files {
+		if !slices.Contains(files, fileName) {
+			changed = append(changed, fileName)
+		}
+	}
+
+	// the manifest can change the order of the files kept
+	reordered := !slices.Equal(keep(files, m.files), keep(m.files, files))
+	if len(changed) == 0 && len(changedOverlays) == 0 && !reordered {
+		return nil, false, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(changedOverlays) > 0 {
+		m.loadOverlays(overlayPaths)
+	}
+
+	affected := make(map[string]bool)
+	addKeys := func(fileName string) {
+		for _, record := range m.contents[fileName] {
+			if key, err := m.recordKey(record); err == nil {
+				affected[key] = true
+			}
+		}
+	}
+
+	for _, fileName := range changed {
+		addKeys(fileName)
+
+		if slices.Contains(files, fileName) {
+			m.loadFile(fileName)
+			addKeys(fileName)
+		} else {
+			delete(m.contents, fileName)
+			delete(m.states, fileName)
+			delete(m.errors, fileName)
+		}
+	}
+
+	m.files = files
+	m.index()
+
+	if reordered {
+		m.matches = make(map[string]int)
+		changed = append(changed, ManifestFile)
+	}
+	for key := range affected {
+		delete(m.matches, key)
+	}
+
+	return append(changedOverlays, changed...), len(changedOverlays) > 0, nil
+}
+
+// keep returns the files also present in the other list, in order.
+func keep(files, others []string) []string {
+	return slices.DeleteFunc(slices.Clone(files), func(fileName string) bool {
+		return !slices.Contains(others, fileName)
+	})
+}
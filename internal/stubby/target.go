@@ -2,8 +2,12 @@ package stubby
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
@@ -13,13 +17,124 @@ type URL struct {
 	Host   string `json:"host"`
 }
 
+// Target is a backend service the requests are forwarded to. The prefix is
+// removed from the forwarded path.
 type Target struct {
-	URL    URL    `json:"url"`
-	Prefix string `json:"prefix,omitempty"`
+	URL     URL          `json:"url"`
+	Prefix  string       `json:"prefix,omitempty"`
+	Match   *TargetMatch `json:"match,omitempty"`
+	Headers *HeaderRules `json:"headers,omitempty"`
 }
 
+// TargetMatch are the conditions a request must also match to be forwarded
+// to the target. An empty header value only requires the header.
+type TargetMatch struct {
+	PathRegex string            `json:"pathRegex,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Methods   []string          `json:"methods,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+
+	pathRegex *regexp.Regexp
+}
+
+func (t *Target) String() string {
+	return t.URL.Scheme + "://" + t.URL.Host
+}
+
+func (t *Target) Compile() error {
+	var errs []error
+
+	if t.Match != nil && t.Match.PathRegex != "" {
+		regex, err := regexp.Compile(t.Match.PathRegex)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid path regex: %w", err))
+		}
+		t.Match.pathRegex = regex
+	}
+
+	if err := t.Headers.Compile(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid headers: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Matches reports if the request matches the prefix and the conditions of the
+// target. The prefix matches whole path segments, so /auth does not match
+// /authors.
 func (t *Target) Matches(r *http.Request) bool {
-	return strings.HasPrefix(r.URL.Path, t.Prefix)
+	return hasPathPrefix(r.URL.Path, t.Prefix) && t.Match.matches(r)
+}
+
+func (m *TargetMatch) matches(r *http.Request) bool {
+	if m == nil {
+		return true
+	}
+
+	if m.pathRegex != nil && !m.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+
+	if m.Host != "" && !matchesHost(m.Host, r.Host) {
+		return false
+	}
+
+	if len(m.Methods) > 0 && !containsFold(m.Methods, r.Method) {
+		return false
+	}
+
+	for name, value := range m.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || (value != "" && !containsFold(values, value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MoreSpecific reports if the target should be chosen over the other target
+// when the request matches both: the longest prefix first, then the most
+// conditions.
+func (t *Target) MoreSpecific(other *Target) bool {
+	if len(t.Prefix) != len(other.Prefix) {
+		return len(t.Prefix) > len(other.Prefix)
+	}
+
+	return t.Match.conditions() > other.Match.conditions()
+}
+
+func (m *TargetMatch) conditions() int {
+	if m == nil {
+		return 0
+	}
+
+	n := len(m.Headers)
+	for _, condition := range []bool{m.PathRegex != "", m.Host != "", len(m.Methods) > 0} {
+		if condition {
+			n++
+		}
+	}
+	return n
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+// matchesHost compares the host with the Host header of the request, with or
+// without its port.
+func matchesHost(host, requestHost string) bool {
+	if strings.EqualFold(host, requestHost) {
+		return true
+	}
+
+	hostname, _, err := net.SplitHostPort(requestHost)
+	return err == nil && strings.EqualFold(host, hostname)
 }
 
 func (t *Target) Rewrite(r *http.Request) {
@@ -28,6 +143,7 @@ func (t *Target) Rewrite(r *http.Request) {
 	r.URL.Path = strings.TrimPrefix(r.URL.Path, t.Prefix)
 	r.URL.Host = t.URL.Host
 	r.URL.Scheme = t.URL.Scheme
+	t.Headers.Apply(r)
 }
 
 func (t *Target) UnmarshalJSON(data []byte) error {